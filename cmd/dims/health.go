@@ -8,19 +8,25 @@ import (
 )
 
 type HealthCmd struct {
+	Probe string `help:"The probe to check (healthz, livez, or readyz)." enum:"healthz,livez,readyz" default:"healthz"`
 }
 
 func (h *HealthCmd) Run() error {
 	config := core.ReadConfig()
 
-	url := fmt.Sprintf("http://localhost%s/healthz", config.BindAddress)
+	url := fmt.Sprintf("http://localhost%s/%s", config.BindAddress, h.Probe)
 	client := http.Client{
 		Timeout: 2 * time.Second,
 	}
 	resp, err := client.Get(url)
-	if err != nil || resp.StatusCode != http.StatusOK {
+	if err != nil {
 		return fmt.Errorf("health check failed: %v", err)
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check failed: %s returned %d", h.Probe, resp.StatusCode)
+	}
 
 	return nil
 }
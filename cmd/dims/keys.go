@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/beetlebugorg/go-dims/internal/core"
+	"github.com/beetlebugorg/go-dims/pkg/dims"
+)
+
+type KeysCmd struct {
+	ImageURL string `arg:"" name:"imageUrl" help:"Source image URL, as passed in the url parameter."`
+	ClientID string `help:"The v4 client id."`
+	Tag      string `help:"The value of the signed tag parameter."`
+	Header   bool   `help:"Print the keys as the response header, formatted for DIMS_SURROGATE_KEY_HEADER."`
+}
+
+func (cmd *KeysCmd) Run() error {
+	keys := dims.SurrogateKeys(cmd.ImageURL, cmd.ClientID, cmd.Tag)
+
+	if cmd.Header {
+		header := core.ReadConfig().SurrogateKeys.Header
+		if header == "" {
+			header = "Surrogate-Key"
+		}
+
+		fmt.Printf("%s: %s\n", header, dims.FormatSurrogateKeys(header, keys))
+		return nil
+	}
+
+	for _, key := range keys {
+		fmt.Println(key)
+	}
+
+	return nil
+}
@@ -9,7 +9,10 @@ import (
 	"github.com/beetlebugorg/go-dims/internal/aws"
 	"github.com/beetlebugorg/go-dims/internal/core"
 	"github.com/beetlebugorg/go-dims/internal/dims"
+	"github.com/beetlebugorg/go-dims/internal/tracing"
 	"github.com/davidbyttow/govips/v2/vips"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"log/slog"
 	"os"
 )
@@ -30,13 +33,30 @@ func main() {
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, opts))
 	slog.SetDefault(logger)
 
+	if _, err := tracing.Setup(context.Background(), config.Tracing.Endpoint,
+		config.Tracing.ServiceName, config.Tracing.SampleRatio); err != nil {
+		slog.Error("Failed to set up tracing.", "error", err)
+	}
+
+	service := dims.NewService(*config)
+
 	handler := func(ctx context.Context, event *events.LambdaFunctionURLRequest) (*events.LambdaFunctionURLStreamingResponse, error) {
-		request, err := aws.NewRequest(*event, *config)
+		// The Lambda may be frozen once the response is returned, so spans are flushed each time.
+		ctx = tracing.Extract(ctx, propagation.MapCarrier(event.Headers))
+		ctx, span := tracing.Tracer.Start(ctx, "dims.lambda", trace.WithSpanKind(trace.SpanKindServer))
+		defer tracing.Flush(context.Background())
+		defer span.End()
+
+		request, err := aws.NewRequest(ctx, *event, *config)
 		if err != nil {
 			return nil, err
 		}
 
-		if err := dims.Handler(request); err != nil {
+		// The Lambda may be frozen once the response is returned, so cached images are
+		// written first.
+		defer service.Flush()
+
+		if err := service.Handler(request); err != nil {
 			if err := request.SendError(err); err != nil {
 				return nil, err
 			}
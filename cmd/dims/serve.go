@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/beetlebugorg/go-dims/internal/core"
+	"github.com/beetlebugorg/go-dims/internal/tracing"
 	"github.com/beetlebugorg/go-dims/pkg/dims"
 	"github.com/davidbyttow/govips/v2/vips"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 type ServeCmd struct {
@@ -39,10 +45,136 @@ func (s *ServeCmd) Run() error {
 		return fmt.Errorf("signing key is required in production mode")
 	}
 
-	err := http.ListenAndServe(config.BindAddress, dims.NewHandler(*config))
+	if config.Admin.BindAddress != "" && config.Admin.Token == "" {
+		slog.Error("DIMS_ADMIN_TOKEN is required when DIMS_ADMIN_BIND_ADDRESS is set.")
+		return fmt.Errorf("admin token is required")
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), config.Tracing.Endpoint,
+		config.Tracing.ServiceName, config.Tracing.SampleRatio)
 	if err != nil {
+		slog.Error("Failed to set up tracing.", "error", err)
+		return err
+	}
+
+	// Flush traces however the server stops, including when requests didn't drain in time.
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), milliseconds(config.Server.ShutdownTimeout))
+		defer cancel()
+
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("Failed to flush traces.", "error", err)
+		}
+	}()
+
+	handler := dims.New(*config)
+	server := &http.Server{
+		Addr:              config.BindAddress,
+		Handler:           handler,
+		ReadHeaderTimeout: milliseconds(config.Server.ReadHeaderTimeout),
+		ReadTimeout:       milliseconds(config.Server.ReadTimeout),
+		WriteTimeout:      milliseconds(config.Server.WriteTimeout),
+		IdleTimeout:       milliseconds(config.Server.IdleTimeout),
+	}
+
+	// Metrics are served on their own address so they aren't exposed alongside the images.
+	var metricsServer *http.Server
+	if config.MetricsBindAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", handler.MetricsHandler())
+
+		metricsServer = &http.Server{
+			Addr:              config.MetricsBindAddress,
+			Handler:           mux,
+			ReadHeaderTimeout: milliseconds(config.Server.ReadHeaderTimeout),
+		}
+
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Metrics server failed.", "error", err)
+			}
+		}()
+	}
+
+	// Admin endpoints, like metrics, are kept off the image address.
+	var adminServer *http.Server
+	if config.Admin.BindAddress != "" {
+		adminServer = &http.Server{
+			Addr:              config.Admin.BindAddress,
+			Handler:           handler.AdminHandler(),
+			ReadHeaderTimeout: milliseconds(config.Server.ReadHeaderTimeout),
+		}
+
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Admin server failed.", "error", err)
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
 		slog.Error("Server failed.", "error", err)
 		return err
+	case <-ctx.Done():
+	}
+
+	// A second signal stops the server immediately.
+	stop()
+
+	// Fail health checks, giving load balancers time to stop sending new requests before the
+	// listener is closed.
+	slog.Info("Shutting down, draining in-flight requests.")
+	handler.Drain()
+	time.Sleep(milliseconds(config.Server.ShutdownDelay))
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), milliseconds(config.Server.ShutdownTimeout))
+	defer cancel()
+
+	// Keep serving metrics until the image requests have drained.
+	if metricsServer != nil {
+		defer metricsServer.Close()
+	}
+
+	if adminServer != nil {
+		defer adminServer.Close()
+	}
+
+	err = server.Shutdown(shutdownCtx)
+
+	// Finish writing the images rendered by the drained requests to the bucket cache.
+	handler.Flush()
+
+	if err != nil {
+		// Requests may still be using libvips, so it's not shut down here.
+		slog.Error("Server did not shut down cleanly.", "error", err)
+		return err
+	}
+
+	if err := <-serverErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
 	}
+
+	// Renders abandoned after a timeout may still be using libvips.
+	if err := handler.Wait(shutdownCtx); err != nil {
+		slog.Error("Renders did not finish, libvips is not shut down.", "error", err)
+		return err
+	}
+
+	vips.Shutdown()
+	slog.Info("Server stopped.")
+
 	return nil
 }
+
+func milliseconds(ms int) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
@@ -0,0 +1,201 @@
+// Package accesslog writes one structured log line per request.
+//
+// Details that are only known deep inside the handler, like the source backend or the output
+// format, are recorded on an entry carried by the request context.
+package accesslog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RequestIDHeader is read from incoming requests, and set on responses and origin requests.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds request IDs taken from clients, longer IDs are replaced.
+const maxRequestIDLength = 128
+
+// entry holds the request details that are filled in while the request is handled.
+type entry struct {
+	mu sync.Mutex
+
+	requestID    string
+	sourceURL    string
+	backend      string
+	outputFormat string
+	clientID     string
+	cache        string
+}
+
+type contextKey struct{}
+
+// NewLogger returns a logger for access logs, in the DIMS_LOG_FORMAT format ("text" or "json").
+func NewLogger(w io.Writer, format string) *slog.Logger {
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(w, nil))
+	}
+
+	return slog.New(slog.NewTextHandler(w, nil))
+}
+
+// Handler assigns each request an ID, taken from the X-Request-ID header or generated, and
+// logs the request to logger once it completes. Nothing is logged when logger is nil.
+func Handler(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get(RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+
+		e := &entry{requestID: requestID}
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), contextKey{}, e)))
+
+		if logger == nil {
+			return
+		}
+
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "access",
+			slog.String("request_id", e.requestID),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Int64("bytes", recorder.bytes),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.String("source_url", e.sourceURL),
+			slog.String("backend", e.backend),
+			slog.String("output_format", e.outputFormat),
+			slog.String("client_id", e.clientID),
+			slog.String("cache", e.cache),
+		)
+	})
+}
+
+// RequestID returns the ID of the request, or an empty string outside of Handler.
+func RequestID(ctx context.Context) string {
+	e := fromContext(ctx)
+	if e == nil {
+		return ""
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.requestID
+}
+
+// SetSource records the source image URL and the backend that fetched it.
+func SetSource(ctx context.Context, sourceURL string, backend string) {
+	update(ctx, func(e *entry) {
+		e.sourceURL = sourceURL
+		e.backend = backend
+	})
+}
+
+// SetOutputFormat records the format of the image sent to the client.
+func SetOutputFormat(ctx context.Context, format string) {
+	update(ctx, func(e *entry) {
+		e.outputFormat = format
+	})
+}
+
+// SetClientID records the v4 client id.
+func SetClientID(ctx context.Context, clientID string) {
+	update(ctx, func(e *entry) {
+		e.clientID = clientID
+	})
+}
+
+// SetCache records the cache outcome, i.e. "hit" or "miss".
+func SetCache(ctx context.Context, outcome string) {
+	update(ctx, func(e *entry) {
+		e.cache = outcome
+	})
+}
+
+func fromContext(ctx context.Context) *entry {
+	if ctx == nil {
+		return nil
+	}
+
+	e, _ := ctx.Value(contextKey{}).(*entry)
+
+	return e
+}
+
+func update(ctx context.Context, f func(e *entry)) {
+	e := fromContext(ctx)
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	f(e)
+}
+
+// validRequestID accepts IDs of visible ASCII characters, so they are safe to log and forward.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= 0x20 || id[i] >= 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+
+	return n, err
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
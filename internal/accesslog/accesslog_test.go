@@ -0,0 +1,104 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlerLogsRequest(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, "json")
+
+	handler := Handler(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetClientID(r.Context(), "client")
+		SetSource(r.Context(), "https://example.com/image.jpg", "http")
+		SetOutputFormat(r.Context(), "webp")
+		SetCache(r.Context(), "miss")
+
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("image"))
+	}))
+
+	request := httptest.NewRequest("GET", "/v5/resize/100x100?url=https://example.com/image.jpg", nil)
+	request.Header.Set(RequestIDHeader, "abc-123")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	assert.Equal(t, "abc-123", recorder.Header().Get(RequestIDHeader))
+
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+
+	assert.Equal(t, "access", line["msg"])
+	assert.Equal(t, "abc-123", line["request_id"])
+	assert.Equal(t, "GET", line["method"])
+	assert.Equal(t, "/v5/resize/100x100", line["path"])
+	assert.Equal(t, float64(201), line["status"])
+	assert.Equal(t, float64(5), line["bytes"])
+	assert.Equal(t, "https://example.com/image.jpg", line["source_url"])
+	assert.Equal(t, "http", line["backend"])
+	assert.Equal(t, "webp", line["output_format"])
+	assert.Equal(t, "client", line["client_id"])
+	assert.Equal(t, "miss", line["cache"])
+	assert.Contains(t, line, "duration_ms")
+}
+
+func TestHandlerGeneratesRequestID(t *testing.T) {
+	tests := []struct {
+		name      string
+		requestID string
+	}{
+		{"missing", ""},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1)},
+		{"control characters", "abc\x00def"},
+		{"spaces", "abc def"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			handler := Handler(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = RequestID(r.Context())
+			}))
+
+			request := httptest.NewRequest("GET", "/healthz", nil)
+			if tt.requestID != "" {
+				request.Header.Set(RequestIDHeader, tt.requestID)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			assert.Len(t, seen, 32)
+			assert.NotEqual(t, tt.requestID, seen)
+			assert.Equal(t, seen, recorder.Header().Get(RequestIDHeader))
+		})
+	}
+}
+
+func TestTextFormat(t *testing.T) {
+	var buf bytes.Buffer
+	handler := Handler(NewLogger(&buf, "text"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz", nil))
+
+	assert.Contains(t, buf.String(), "msg=access")
+	assert.Contains(t, buf.String(), "status=200")
+	assert.Contains(t, buf.String(), "path=/healthz")
+}
+
+func TestSettersWithoutEntry(t *testing.T) {
+	request := httptest.NewRequest("GET", "/", nil)
+
+	assert.NotPanics(t, func() {
+		SetSource(request.Context(), "https://example.com/image.jpg", "http")
+		SetOutputFormat(request.Context(), "jpeg")
+	})
+	assert.Equal(t, "", RequestID(request.Context()))
+}
@@ -0,0 +1,216 @@
+// Package admission limits how much image processing can happen at once.
+package admission
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrSaturated is returned when a request can't be admitted, either because the wait queue is
+// full or because it waited longer than the queue timeout.
+var ErrSaturated = errors.New("admission: too many requests")
+
+// Limiter is a weighted semaphore with a bounded, first-in first-out wait queue.
+//
+// Each request acquires a weight, its estimated cost, and releases it when done. Requests that
+// don't fit wait in the queue for up to the queue timeout. Requests arriving when the queue is
+// full are rejected immediately.
+//
+// A nil *Limiter admits everything.
+type Limiter struct {
+	capacity     int64
+	maxQueue     int
+	queueTimeout time.Duration
+
+	mu       sync.Mutex
+	used     int64
+	inFlight int64
+	waiters  list.List
+
+	admitted    int64
+	rejected    int64
+	waitCount   int64
+	waitTotal   time.Duration
+	waitMaximum time.Duration
+}
+
+type waiter struct {
+	weight int64
+	ready  chan struct{}
+}
+
+// Stats is a snapshot of the limiter state, for monitoring.
+type Stats struct {
+	Capacity    int64         `json:"capacity"`     // Total weight that can be in use at once.
+	Used        int64         `json:"used"`         // Weight currently in use.
+	InFlight    int64         `json:"in_flight"`    // Requests currently admitted.
+	QueueDepth  int           `json:"queue_depth"`  // Requests currently waiting.
+	Admitted    int64         `json:"admitted"`     // Requests admitted since startup.
+	Rejected    int64         `json:"rejected"`     // Requests rejected since startup.
+	WaitCount   int64         `json:"wait_count"`   // Requests that had to wait since startup.
+	WaitTotal   time.Duration `json:"wait_total"`   // Total time spent waiting since startup.
+	WaitMaximum time.Duration `json:"wait_maximum"` // Longest wait since startup.
+}
+
+// NewLimiter returns a limiter that admits up to capacity weight at once, with up to maxQueue
+// requests waiting for up to queueTimeout. It returns nil, admitting everything, if capacity
+// is not positive.
+func NewLimiter(capacity int64, maxQueue int, queueTimeout time.Duration) *Limiter {
+	if capacity <= 0 {
+		return nil
+	}
+
+	return &Limiter{
+		capacity:     capacity,
+		maxQueue:     maxQueue,
+		queueTimeout: queueTimeout,
+	}
+}
+
+// Acquire waits until weight is available and returns a function that releases it.
+//
+// Weights larger than the capacity are reduced to the capacity, so expensive requests run
+// alone rather than never. It returns ErrSaturated if the request can't be admitted, or the
+// context error if ctx is done first.
+func (l *Limiter) Acquire(ctx context.Context, weight int64) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	weight = min(max(weight, 1), l.capacity)
+
+	l.mu.Lock()
+	if l.used+weight <= l.capacity && l.waiters.Len() == 0 {
+		l.admit(weight)
+		l.mu.Unlock()
+
+		return l.releaser(weight), nil
+	}
+
+	if l.waiters.Len() >= l.maxQueue {
+		l.rejected++
+		l.mu.Unlock()
+
+		return nil, ErrSaturated
+	}
+
+	w := &waiter{weight: weight, ready: make(chan struct{})}
+	element := l.waiters.PushBack(w)
+	l.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+		l.recordWait(time.Since(start))
+		return l.releaser(weight), nil
+	case <-timer.C:
+		err = ErrSaturated
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	select {
+	case <-w.ready:
+		// Admitted while timing out, give the weight back.
+		l.release(weight)
+	default:
+		l.waiters.Remove(element)
+
+		// Removing a large waiter from the front may let smaller ones through.
+		l.notifyWaiters()
+	}
+
+	if err == ErrSaturated {
+		l.rejected++
+	}
+	l.mu.Unlock()
+
+	return nil, err
+}
+
+// Stats returns a snapshot of the limiter state.
+func (l *Limiter) Stats() Stats {
+	if l == nil {
+		return Stats{}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return Stats{
+		Capacity:    l.capacity,
+		Used:        l.used,
+		InFlight:    l.inFlight,
+		QueueDepth:  l.waiters.Len(),
+		Admitted:    l.admitted,
+		Rejected:    l.rejected,
+		WaitCount:   l.waitCount,
+		WaitTotal:   l.waitTotal,
+		WaitMaximum: l.waitMaximum,
+	}
+}
+
+func (l *Limiter) releaser(weight int64) func() {
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			l.release(weight)
+			l.mu.Unlock()
+		})
+	}
+}
+
+// admit must be called with l.mu held.
+func (l *Limiter) admit(weight int64) {
+	l.used += weight
+	l.inFlight++
+	l.admitted++
+}
+
+// release must be called with l.mu held.
+func (l *Limiter) release(weight int64) {
+	l.used -= weight
+	l.inFlight--
+	l.notifyWaiters()
+}
+
+// notifyWaiters admits waiters, in order, for as long as they fit. It must be called with
+// l.mu held.
+func (l *Limiter) notifyWaiters() {
+	for {
+		front := l.waiters.Front()
+		if front == nil {
+			return
+		}
+
+		w := front.Value.(*waiter)
+		if l.used+w.weight > l.capacity {
+			return
+		}
+
+		l.admit(w.weight)
+		l.waiters.Remove(front)
+		close(w.ready)
+	}
+}
+
+func (l *Limiter) recordWait(wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.waitCount++
+	l.waitTotal += wait
+	if wait > l.waitMaximum {
+		l.waitMaximum = wait
+	}
+}
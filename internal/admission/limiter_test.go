@@ -0,0 +1,114 @@
+package admission
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiterAdmitsWithinCapacity(t *testing.T) {
+	limiter := NewLimiter(10, 1, time.Second)
+
+	release1, err := limiter.Acquire(context.Background(), 6)
+	require.NoError(t, err)
+
+	release2, err := limiter.Acquire(context.Background(), 4)
+	require.NoError(t, err)
+
+	stats := limiter.Stats()
+	assert.Equal(t, int64(10), stats.Used)
+	assert.Equal(t, int64(2), stats.InFlight)
+
+	release1()
+	release1()
+	release2()
+
+	stats = limiter.Stats()
+	assert.Equal(t, int64(0), stats.Used)
+	assert.Equal(t, int64(0), stats.InFlight)
+	assert.Equal(t, int64(2), stats.Admitted)
+}
+
+func TestLimiterQueues(t *testing.T) {
+	limiter := NewLimiter(10, 1, time.Second)
+
+	release, err := limiter.Acquire(context.Background(), 10)
+	require.NoError(t, err)
+
+	admitted := make(chan error)
+	go func() {
+		release, err := limiter.Acquire(context.Background(), 5)
+		if err == nil {
+			release()
+		}
+		admitted <- err
+	}()
+
+	require.Eventually(t, func() bool { return limiter.Stats().QueueDepth == 1 }, time.Second, time.Millisecond)
+	release()
+
+	require.NoError(t, <-admitted)
+	assert.Equal(t, int64(1), limiter.Stats().WaitCount)
+}
+
+func TestLimiterRejectsWhenQueueIsFull(t *testing.T) {
+	limiter := NewLimiter(1, 0, time.Second)
+
+	release, err := limiter.Acquire(context.Background(), 1)
+	require.NoError(t, err)
+	defer release()
+
+	_, err = limiter.Acquire(context.Background(), 1)
+	assert.ErrorIs(t, err, ErrSaturated)
+	assert.Equal(t, int64(1), limiter.Stats().Rejected)
+}
+
+func TestLimiterQueueTimeout(t *testing.T) {
+	limiter := NewLimiter(1, 1, 10*time.Millisecond)
+
+	release, err := limiter.Acquire(context.Background(), 1)
+	require.NoError(t, err)
+	defer release()
+
+	_, err = limiter.Acquire(context.Background(), 1)
+	assert.ErrorIs(t, err, ErrSaturated)
+	assert.Equal(t, 0, limiter.Stats().QueueDepth)
+}
+
+func TestLimiterContextCanceled(t *testing.T) {
+	limiter := NewLimiter(1, 1, time.Second)
+
+	release, err := limiter.Acquire(context.Background(), 1)
+	require.NoError(t, err)
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = limiter.Acquire(ctx, 1)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 0, limiter.Stats().QueueDepth)
+}
+
+func TestLimiterClampsWeightToCapacity(t *testing.T) {
+	limiter := NewLimiter(4, 0, time.Second)
+
+	release, err := limiter.Acquire(context.Background(), 100)
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(4), limiter.Stats().Used)
+	release()
+}
+
+func TestNilLimiterAdmitsEverything(t *testing.T) {
+	limiter := NewLimiter(0, 0, 0)
+
+	release, err := limiter.Acquire(context.Background(), 100)
+	require.NoError(t, err)
+	release()
+
+	assert.Equal(t, Stats{}, limiter.Stats())
+}
@@ -2,9 +2,11 @@ package aws
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/beetlebugorg/go-dims/internal/cache"
 	"github.com/beetlebugorg/go-dims/internal/commands"
 	"github.com/beetlebugorg/go-dims/internal/core"
 	"github.com/beetlebugorg/go-dims/internal/dims"
@@ -25,7 +27,7 @@ type Request struct {
 	response *events.LambdaFunctionURLStreamingResponse
 }
 
-func NewRequest(event events.LambdaFunctionURLRequest, config core.Config) (*Request, error) {
+func NewRequest(ctx context.Context, event events.LambdaFunctionURLRequest, config core.Config) (*Request, error) {
 	requestUrl, err := url.Parse(event.RawPath + "?" + event.RawQueryString)
 	if err != nil {
 		return nil, err
@@ -36,8 +38,14 @@ func NewRequest(event events.LambdaFunctionURLRequest, config core.Config) (*Req
 			Headers: map[string]string{},
 		},
 	}
-	httpRequest := &http.Request{
-		URL: requestUrl,
+	httpRequest := (&http.Request{
+		URL:    requestUrl,
+		Header: http.Header{},
+	}).WithContext(ctx)
+
+	// Function URL headers are lowercase, Set canonicalizes them.
+	for key, value := range event.Headers {
+		httpRequest.Header.Set(key, value)
 	}
 
 	// Commands can be v4 (/dims4/...) or v5 (/v5/...)
@@ -78,41 +86,46 @@ func NewRequest(event events.LambdaFunctionURLRequest, config core.Config) (*Req
 }
 
 func (r *Request) sendHeaders() {
-	headers := make(map[string]string)
-
-	if r.RequestContext.CacheControl() != "" {
-		headers["Cache-Control"] = r.CacheControl()
-	}
+	r.response.Headers = dims.ResponseHeaders(r.RequestContext)
+}
 
-	if r.RequestContext.Etag() != "" {
-		headers["ETag"] = r.Etag()
+func (r *Request) SendImage(status int, imageFormat string, imageBlob []byte) error {
+	if status == http.StatusOK {
+		r.sendHeaders()
 	}
 
-	if r.RequestContext.Expires() != "" {
-		headers["Expires"] = r.Expires()
-	}
+	return r.writeImage(status, imageFormat, imageBlob)
+}
 
-	if r.RequestContext.LastModified() != "" {
-		headers["Last-Modified"] = r.LastModified()
+// SendCached sends a rendered image from the cache, with the headers it was first sent with.
+func (r *Request) SendCached(entry *cache.Entry) error {
+	headers := make(map[string]string, len(entry.Headers)+1)
+	for key, value := range entry.Headers {
+		headers[key] = value
 	}
+	headers["Age"] = strconv.Itoa(int(time.Since(entry.Created).Seconds()))
+	r.response.Headers = headers
 
-	if r.RequestContext.ContentDisposition() != "" {
-		headers["Content-Disposition"] = r.ContentDisposition()
-	}
+	return r.writeImage(http.StatusOK, entry.Format, entry.Body)
+}
 
-	if r.RequestContext.EdgeControl() != "" {
-		headers["Edge-Control"] = r.EdgeControl()
+// SendNotModified tells the client its copy of the image is still current.
+func (r *Request) SendNotModified(headers map[string]string) error {
+	r.response = &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: http.StatusNotModified,
+		Headers:    headers,
+		Body:       bytes.NewReader(nil),
 	}
 
-	r.response.Headers = headers
+	return nil
 }
 
-func (r *Request) SendImage(status int, imageFormat string, imageBlob []byte) error {
-	if status == http.StatusOK {
-		r.sendHeaders()
+func (r *Request) writeImage(status int, imageFormat string, imageBlob []byte) error {
+	headers := r.Response().Headers
+	for key, value := range r.DebugHeaders(imageFormat, imageBlob) {
+		headers[key] = value
 	}
 
-	headers := r.Response().Headers
 	headers["Content-Type"] = fmt.Sprintf("image/%s", strings.ToLower(imageFormat))
 	headers["Content-Length"] = strconv.Itoa(len(imageBlob))
 
@@ -131,10 +144,12 @@ func (r *Request) SendError(err error) error {
 
 	// Send error headers.
 	headers := r.Response().Headers
-	maxAge := r.Config().OriginCacheControl.Error
-	if maxAge > 0 {
-		headers["Cache-Control"] = fmt.Sprintf("max-age=%d, public", maxAge)
-		headers["Expires"] = time.Now().Add(time.Duration(maxAge) * time.Second).UTC().Format(http.TimeFormat)
+	for key, value := range dims.ErrorHeaders(r.Config()) {
+		headers[key] = value
+	}
+
+	if header, keys := r.SurrogateKey(); header != "" {
+		headers[header] = keys
 	}
 
 	// Strip stack from vips errors.
@@ -150,6 +165,10 @@ func (r *Request) SendError(err error) error {
 	var operationError *commands.OperationError
 	if errors.As(err, &statusError) {
 		status = statusError.StatusCode
+
+		if statusError.RetryAfter > 0 {
+			headers["Retry-After"] = strconv.Itoa(statusError.RetryAfter)
+		}
 	} else if errors.As(err, &operationError) {
 		status = operationError.StatusCode
 	}
@@ -159,7 +178,7 @@ func (r *Request) SendError(err error) error {
 		return err
 	}
 
-	imageType, imageBlob, err := r.ProcessImage(errorImage, true)
+	imageType, imageBlob, err := r.ProcessImage(r.Context(), errorImage, true)
 	if err != nil {
 		// If processing failed because of a bad command then return the image as-is.
 		exportOptions := vips.NewJpegExportParams()
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package cache
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime returns the last modification time, access times aren't available everywhere.
+func accessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
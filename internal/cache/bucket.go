@@ -0,0 +1,304 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// BucketClient is the part of the S3 client used by the bucket cache.
+type BucketClient interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+}
+
+// sourceMetadata is the object metadata holding a hash of the entry's source image URL, so
+// purges can find the entries made from it without downloading them.
+const sourceMetadata = "dims-source"
+
+// Bucket is a cache in an S3-compatible bucket, shared by every instance of the service.
+//
+// Keys map to object keys under the prefix, with each ":" in the key starting a new level, so
+// "render:webp:<hash>" is stored as "<prefix>render/webp/<hash>". Bucket lifecycle rules can
+// then expire each kind of entry, or each output format, on its own schedule.
+//
+// Entries are written in the background, so a slow bucket never delays a response, and every
+// request to the bucket is bounded by the timeout. Flush waits for the writes, it must be called
+// before the process exits or is frozen, i.e. at the end of each Lambda invocation.
+type Bucket struct {
+	client  BucketClient
+	bucket  string
+	prefix  string
+	timeout time.Duration
+	now     func() time.Time
+
+	writes sync.WaitGroup
+
+	mu          sync.Mutex
+	hits        int64
+	misses      int64
+	expirations int64
+	errors      int64
+}
+
+// NewBucket returns a cache storing entries in bucket, under prefix.
+func NewBucket(client BucketClient, bucket string, prefix string, timeout time.Duration) *Bucket {
+	return &Bucket{
+		client:  client,
+		bucket:  bucket,
+		prefix:  prefix,
+		timeout: timeout,
+		now:     time.Now,
+	}
+}
+
+// Get returns the entry for key, if it is in the bucket and hasn't expired.
+func (b *Bucket) Get(ctx context.Context, key string) (*Entry, bool) {
+	entry, err := b.read(ctx, key)
+	if err != nil {
+		if !notFound(err) {
+			slog.Error("bucket cache read failed", "error", err)
+			b.count(&b.errors)
+		}
+
+		b.count(&b.misses)
+		return nil, false
+	}
+
+	if entry.Expired(b.now()) {
+		b.count(&b.expirations)
+		b.count(&b.misses)
+		return nil, false
+	}
+
+	b.count(&b.hits)
+
+	return entry, true
+}
+
+// Set writes entry to the bucket under key, in the background.
+func (b *Bucket) Set(ctx context.Context, key string, entry *Entry) {
+	if entry.Expired(b.now()) {
+		return
+	}
+
+	data, err := encodeEntry(key, entry)
+	if err != nil {
+		slog.Error("bucket cache write failed", "error", err)
+		b.count(&b.errors)
+		return
+	}
+
+	b.writes.Add(1)
+	go func() {
+		defer b.writes.Done()
+
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), b.timeout)
+		defer cancel()
+
+		_, err := b.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(b.bucket),
+			Key:         aws.String(b.objectKey(key)),
+			Body:        bytes.NewReader(data),
+			ContentType: aws.String("application/octet-stream"),
+			Expires:     aws.Time(entry.Expires),
+			Metadata:    map[string]string{sourceMetadata: sourceHash(entry.Source)},
+		})
+		if err != nil {
+			slog.Error("bucket cache write failed", "error", err)
+			b.count(&b.errors)
+		}
+	}()
+}
+
+// Flush waits for the entries being written in the background.
+func (b *Bucket) Flush() {
+	b.writes.Wait()
+}
+
+// PurgeSource deletes every object made from the source image URL, returning how many. Every
+// object under the prefix is checked, from its metadata or, for objects written without it,
+// its contents.
+func (b *Bucket) PurgeSource(ctx context.Context, source string) (int, error) {
+	hash := sourceHash(source)
+
+	return b.purge(ctx, func(ctx context.Context, objectKey string) (bool, error) {
+		head, err := b.client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(b.bucket),
+			Key:    aws.String(objectKey),
+		})
+		if err != nil {
+			return false, err
+		}
+
+		if objectHash, ok := head.Metadata[sourceMetadata]; ok {
+			return objectHash == hash, nil
+		}
+
+		output, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(b.bucket),
+			Key:    aws.String(objectKey),
+		})
+		if err != nil {
+			return false, err
+		}
+		defer output.Body.Close()
+
+		data, err := io.ReadAll(output.Body)
+		if err != nil {
+			return false, err
+		}
+
+		metadata, err := decodeMetadata(data)
+		if err != nil {
+			return false, nil
+		}
+
+		return metadata.Source == source, nil
+	})
+}
+
+// PurgeAll deletes every object under the prefix, returning how many.
+func (b *Bucket) PurgeAll(ctx context.Context) (int, error) {
+	return b.purge(ctx, func(ctx context.Context, objectKey string) (bool, error) {
+		return true, nil
+	})
+}
+
+// purge deletes the objects under the prefix that match, a page of objects at a time. Pending
+// writes are waited for first, so they can't put back an object after it is deleted.
+//
+// Each request to the bucket is bounded by the timeout, rather than the whole purge.
+func (b *Bucket) purge(ctx context.Context, match func(ctx context.Context, objectKey string) (bool, error)) (int, error) {
+	b.Flush()
+
+	purged := 0
+	paginator := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(b.prefix),
+	})
+	for paginator.HasMorePages() {
+		listCtx, cancel := context.WithTimeout(ctx, b.timeout)
+		page, err := paginator.NextPage(listCtx)
+		cancel()
+		if err != nil {
+			return purged, err
+		}
+
+		var objects []types.ObjectIdentifier
+		for _, object := range page.Contents {
+			requestCtx, cancel := context.WithTimeout(ctx, b.timeout)
+			matched, err := match(requestCtx, aws.ToString(object.Key))
+			cancel()
+
+			// Objects may expire, or be purged by another instance, while the bucket is listed.
+			if err != nil && !notFound(err) {
+				return purged, err
+			}
+
+			if matched {
+				objects = append(objects, types.ObjectIdentifier{Key: object.Key})
+			}
+		}
+
+		if len(objects) == 0 {
+			continue
+		}
+
+		deleteCtx, cancel := context.WithTimeout(ctx, b.timeout)
+		output, err := b.client.DeleteObjects(deleteCtx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(b.bucket),
+			Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		cancel()
+		if err != nil {
+			return purged, err
+		}
+
+		purged += len(objects) - len(output.Errors)
+		if len(output.Errors) > 0 {
+			return purged, fmt.Errorf("deleting %s: %s", aws.ToString(output.Errors[0].Key),
+				aws.ToString(output.Errors[0].Message))
+		}
+	}
+
+	return purged, nil
+}
+
+// Stats returns the lookups made since startup. The size of the bucket isn't tracked.
+func (b *Bucket) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return Stats{
+		Hits:        b.hits,
+		Misses:      b.misses,
+		Expirations: b.expirations,
+		Errors:      b.errors,
+	}
+}
+
+func (b *Bucket) read(ctx context.Context, key string) (*Entry, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+
+	output, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.objectKey(key)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	data, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeEntry(data, key)
+}
+
+// sourceHash is the hash of a source image URL stored in the object metadata. Metadata is sent
+// as HTTP headers, so the URL itself may not fit.
+func sourceHash(source string) string {
+	hash := sha256.Sum256([]byte(source))
+
+	return hex.EncodeToString(hash[:])
+}
+
+func (b *Bucket) objectKey(key string) string {
+	return b.prefix + strings.ReplaceAll(key, ":", "/")
+}
+
+func (b *Bucket) count(counter *int64) {
+	b.mu.Lock()
+	*counter++
+	b.mu.Unlock()
+}
+
+// notFound is true for missing objects, and for objects stored under a different key.
+func notFound(err error) bool {
+	var status interface{ HTTPStatusCode() int }
+	if errors.As(err, &status) && status.HTTPStatusCode() == 404 {
+		return true
+	}
+
+	return errors.Is(err, fs.ErrNotExist)
+}
@@ -0,0 +1,220 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBucket stores objects in memory, failing every request when err is set.
+type fakeBucket struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	metadata map[string]map[string]string
+	err      error
+}
+
+func newFakeBucket() *fakeBucket {
+	return &fakeBucket{objects: make(map[string][]byte), metadata: make(map[string]map[string]string)}
+}
+
+func (f *fakeBucket) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	data, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &awshttp.ResponseError{ResponseError: &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: 404}},
+			Err:      errors.New("NoSuchKey"),
+		}}
+	}
+
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (f *fakeBucket) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[aws.ToString(params.Key)] = data
+	f.metadata[aws.ToString(params.Key)] = params.Metadata
+
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeBucket) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	return &s3.HeadObjectOutput{Metadata: f.metadata[aws.ToString(params.Key)]}, nil
+}
+
+// ListObjectsV2 lists one object per page, to cover paging.
+func (f *fakeBucket) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.ToString(params.Prefix)) && key > aws.ToString(params.ContinuationToken) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	output := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(len(keys) > 1)}
+	if len(keys) > 0 {
+		output.Contents = []types.Object{{Key: aws.String(keys[0])}}
+		if len(keys) > 1 {
+			output.NextContinuationToken = aws.String(keys[0])
+		}
+	}
+
+	return output, nil
+}
+
+func (f *fakeBucket) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	for _, object := range params.Delete.Objects {
+		delete(f.objects, aws.ToString(object.Key))
+		delete(f.metadata, aws.ToString(object.Key))
+	}
+
+	return &s3.DeleteObjectsOutput{}, nil
+}
+
+func TestBucketGetSet(t *testing.T) {
+	client := newFakeBucket()
+	b := NewBucket(client, "images", "dims/", time.Second)
+	ctx := context.Background()
+
+	_, ok := b.Get(ctx, "render:webp:abc")
+	assert.False(t, ok)
+
+	entry := newEntry("image", time.Minute)
+	entry.Headers = map[string]string{"ETag": "abc"}
+	b.Set(ctx, "render:webp:abc", entry)
+	b.Flush()
+
+	assert.Contains(t, client.objects, "dims/render/webp/abc")
+
+	cached, ok := b.Get(ctx, "render:webp:abc")
+	require.True(t, ok)
+	assert.Equal(t, []byte("image"), cached.Body)
+	assert.Equal(t, "abc", cached.Headers["ETag"])
+
+	stats := b.Stats()
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+	assert.Equal(t, int64(0), stats.Errors)
+}
+
+func TestBucketExpires(t *testing.T) {
+	client := newFakeBucket()
+	b := NewBucket(client, "images", "", time.Second)
+	ctx := context.Background()
+
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	b.Set(ctx, "a", newEntry("image", time.Minute))
+	b.Flush()
+
+	now = now.Add(2 * time.Minute)
+	_, ok := b.Get(ctx, "a")
+	assert.False(t, ok)
+	assert.Equal(t, int64(1), b.Stats().Expirations)
+}
+
+func TestBucketFailsOpen(t *testing.T) {
+	client := newFakeBucket()
+	client.err = errors.New("connection refused")
+	b := NewBucket(client, "images", "", time.Second)
+	ctx := context.Background()
+
+	b.Set(ctx, "a", newEntry("image", time.Minute))
+	b.Flush()
+
+	_, ok := b.Get(ctx, "a")
+	assert.False(t, ok)
+	assert.Equal(t, int64(2), b.Stats().Errors)
+}
+
+func TestBucketPurge(t *testing.T) {
+	client := newFakeBucket()
+	b := NewBucket(client, "images", "dims/", time.Second)
+	ctx := context.Background()
+
+	for key, source := range map[string]string{"render:webp:a": "https://example.com/a", "render:png:b": "https://example.com/a", "render:webp:c": "https://example.com/c"} {
+		entry := newEntry("image", time.Minute)
+		entry.Source = source
+		b.Set(ctx, key, entry)
+	}
+
+	// Objects written without the source metadata are read to find their source.
+	b.Flush()
+	delete(client.metadata, "dims/render/png/b")
+
+	// Objects outside the prefix aren't touched.
+	client.objects["other/object"] = []byte("other")
+
+	purged, err := b.PurgeSource(ctx, "https://example.com/a")
+	require.NoError(t, err)
+	assert.Equal(t, 2, purged)
+
+	_, ok := b.Get(ctx, "render:webp:a")
+	assert.False(t, ok)
+	_, ok = b.Get(ctx, "render:webp:c")
+	assert.True(t, ok)
+
+	purged, err = b.PurgeAll(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	assert.Equal(t, map[string][]byte{"other/object": []byte("other")}, client.objects)
+
+	client.err = errors.New("connection refused")
+	_, err = b.PurgeAll(ctx)
+	assert.Error(t, err, "a failed purge is reported")
+}
@@ -0,0 +1,168 @@
+// Package cache stores rendered images, so that repeated requests skip fetching and processing.
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Entry is a rendered image along with the response headers it was sent with.
+type Entry struct {
+	Format  string            // The output image format, i.e. "jpeg".
+	Body    []byte            // The encoded image.
+	Headers map[string]string // The response headers, i.e. Cache-Control and ETag.
+	Source  string            // The URL of the source image, used to purge every entry made from it.
+	Created time.Time         // When the image was rendered.
+	Expires time.Time         // When the entry should no longer be served.
+}
+
+// Size is the approximate memory used by the entry, in bytes.
+func (e *Entry) Size() int64 {
+	size := int64(len(e.Format) + len(e.Body))
+	for key, value := range e.Headers {
+		size += int64(len(key) + len(value))
+	}
+
+	return size
+}
+
+// Expired is true once the entry is past its expiry time.
+func (e *Entry) Expired(now time.Time) bool {
+	return !now.Before(e.Expires)
+}
+
+// Cache is implemented by each cache backend.
+//
+// Caches fail open: errors are handled by the backend, and reported to callers as a miss, so
+// that a broken cache never stops images from being served.
+type Cache interface {
+	Get(ctx context.Context, key string) (*Entry, bool)
+	Set(ctx context.Context, key string, entry *Entry)
+}
+
+// Purger is implemented by caches that can evict entries on demand, i.e. when a source image
+// is replaced at the origin.
+//
+// Unlike lookups, purges report their errors, since a cache that still holds a purged entry
+// would go on serving it.
+type Purger interface {
+	// PurgeSource evicts every entry made from the source image URL, returning how many.
+	PurgeSource(ctx context.Context, source string) (int, error)
+
+	// PurgeAll evicts every entry, returning how many.
+	PurgeAll(ctx context.Context) (int, error)
+}
+
+// Flusher is implemented by caches that write entries in the background.
+type Flusher interface {
+	// Flush waits for the entries being written.
+	Flush()
+}
+
+// Stats reports the state of a cache.
+type Stats struct {
+	Entries     int   `json:"entries"`     // Entries currently cached.
+	Bytes       int64 `json:"bytes"`       // Size of the entries currently cached.
+	MaxBytes    int64 `json:"max_bytes"`   // Maximum size of the cache.
+	Hits        int64 `json:"hits"`        // Lookups that found an entry since startup.
+	Misses      int64 `json:"misses"`      // Lookups that found nothing since startup.
+	Evictions   int64 `json:"evictions"`   // Entries evicted to make room since startup.
+	Expirations int64 `json:"expirations"` // Entries removed after expiring since startup.
+	Errors      int64 `json:"errors"`      // Reads and writes that failed since startup.
+}
+
+// purgeTTL is how long Tiers remembers a purge. It only needs to outlast the lookups that were
+// already running when the purge started.
+const purgeTTL = time.Minute
+
+// Tiers is a cache made of faster caches in front of slower ones, i.e. memory in front of disk.
+//
+// Tiers are purged one at a time, so a lookup running alongside a purge could find an entry in
+// a slower tier that hasn't been purged yet, and copy it back into a faster one that has. Purges
+// are recorded with Purged and PurgedAll before purging the tiers, and entries created before
+// them are ignored from then on.
+type Tiers struct {
+	caches []Cache
+	now    func() time.Time
+
+	mu        sync.Mutex
+	purgedAll time.Time
+	purged    map[string]time.Time // When each source was last purged.
+}
+
+// NewTiers returns a cache checking caches in order, the fastest first.
+func NewTiers(caches ...Cache) *Tiers {
+	return &Tiers{
+		caches: caches,
+		now:    time.Now,
+		purged: make(map[string]time.Time),
+	}
+}
+
+// Get checks each tier in order. A hit is copied into the tiers in front of the one it was
+// found in, so it is faster next time.
+func (t *Tiers) Get(ctx context.Context, key string) (*Entry, bool) {
+	for i, tier := range t.caches {
+		entry, ok := tier.Get(ctx, key)
+		if !ok {
+			continue
+		}
+
+		if t.wasPurged(entry) {
+			return nil, false
+		}
+
+		for _, front := range t.caches[:i] {
+			front.Set(ctx, key, entry)
+		}
+
+		return entry, true
+	}
+
+	return nil, false
+}
+
+// Set stores the entry in every tier.
+func (t *Tiers) Set(ctx context.Context, key string, entry *Entry) {
+	for _, tier := range t.caches {
+		tier.Set(ctx, key, entry)
+	}
+}
+
+// Purged records that the entries made from source until now are being purged.
+func (t *Tiers) Purged(source string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	for purgedSource, purged := range t.purged {
+		if now.Sub(purged) > purgeTTL {
+			delete(t.purged, purgedSource)
+		}
+	}
+
+	t.purged[source] = now
+}
+
+// PurgedAll records that every entry made until now is being purged.
+func (t *Tiers) PurgedAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.purgedAll = t.now()
+}
+
+// wasPurged is true for entries created before a purge that covers them.
+func (t *Tiers) wasPurged(entry *Entry) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.purgedAll.IsZero() && !entry.Created.After(t.purgedAll) {
+		return true
+	}
+
+	purged, ok := t.purged[entry.Source]
+
+	return ok && !entry.Created.After(purged)
+}
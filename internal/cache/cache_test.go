@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTiersFillFrontTiers(t *testing.T) {
+	memory := NewMemory(1024)
+	disk, err := NewDisk(t.TempDir(), 1024)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	tiers := NewTiers(memory, disk)
+
+	disk.Set(ctx, "a", newEntry("image", time.Minute))
+
+	entry, ok := tiers.Get(ctx, "a")
+	require.True(t, ok)
+	assert.Equal(t, []byte("image"), entry.Body)
+
+	_, ok = memory.Get(ctx, "a")
+	assert.True(t, ok)
+}
+
+func TestTiersSetAll(t *testing.T) {
+	memory := NewMemory(1024)
+	disk, err := NewDisk(t.TempDir(), 1024)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	NewTiers(memory, disk).Set(ctx, "a", newEntry("image", time.Minute))
+
+	_, ok := memory.Get(ctx, "a")
+	assert.True(t, ok)
+	_, ok = disk.Get(ctx, "a")
+	assert.True(t, ok)
+
+	_, ok = NewTiers(memory, disk).Get(ctx, "b")
+	assert.False(t, ok)
+}
+
+func TestTiersDontRestorePurgedEntries(t *testing.T) {
+	memory := NewMemory(1024)
+	disk, err := NewDisk(t.TempDir(), 1024)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	tiers := NewTiers(memory, disk)
+	now := time.Now()
+	tiers.now = func() time.Time { return now }
+
+	entry := newEntry("image", time.Minute)
+	entry.Source = "https://example.com/a"
+	entry.Created = now.Add(-time.Second)
+	tiers.Set(ctx, "a", entry)
+
+	// The front tier is purged, while the entry is still in the slower one.
+	tiers.Purged("https://example.com/a")
+	assert.Equal(t, 1, purged(memory.PurgeSource(ctx, "https://example.com/a")))
+
+	_, ok := tiers.Get(ctx, "a")
+	assert.False(t, ok, "the entry was made before the purge")
+	_, ok = memory.Get(ctx, "a")
+	assert.False(t, ok, "the entry isn't copied back into the front tier")
+
+	// Entries made after the purge are served as usual.
+	fresh := newEntry("fresh", time.Minute)
+	fresh.Source = "https://example.com/a"
+	fresh.Created = now.Add(time.Second)
+	disk.Set(ctx, "a", fresh)
+
+	got, ok := tiers.Get(ctx, "a")
+	require.True(t, ok)
+	assert.Equal(t, []byte("fresh"), got.Body)
+
+	tiers.PurgedAll()
+	_, ok = tiers.Get(ctx, "a")
+	assert.True(t, ok, "entries made after the purge of every entry are kept")
+
+	now = now.Add(2 * time.Second)
+	tiers.PurgedAll()
+	_, ok = tiers.Get(ctx, "a")
+	assert.False(t, ok)
+}
+
+// purged returns the number of entries purged, for purges that can't fail.
+func purged(count int, err error) int {
+	if err != nil {
+		panic(err)
+	}
+
+	return count
+}
@@ -0,0 +1,374 @@
+package cache
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tempPrefix marks files that are still being written, they are removed on startup.
+const tempPrefix = ".tmp-"
+
+// Disk is a cache of files in a directory, evicting the least recently accessed files once
+// it holds more than its maximum size.
+//
+// Each entry is written to a temporary file and renamed into place, so readers never see a
+// partial file, even after a crash. The index is rebuilt from the directory on startup, using
+// the access time of each file, so the cache survives restarts.
+type Disk struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	size     int64
+	lru      *list.List // Most recently accessed at the front.
+	files    map[string]*list.Element
+	now      func() time.Time
+
+	hits        int64
+	misses      int64
+	evictions   int64
+	expirations int64
+}
+
+type diskFile struct {
+	name  string
+	size  int64
+	atime time.Time
+}
+
+// NewDisk returns a cache of up to maxBytes in dir, creating the directory if needed and
+// indexing any files already there.
+func NewDisk(dir string, maxBytes int64) (*Disk, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	d := &Disk{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		files:    make(map[string]*list.Element),
+		now:      time.Now,
+	}
+
+	if err := d.rebuild(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Get returns the entry for key, if it is cached and hasn't expired.
+func (d *Disk) Get(ctx context.Context, key string) (*Entry, bool) {
+	name := fileName(key)
+
+	d.mu.Lock()
+	element, ok := d.files[name]
+	if !ok {
+		d.misses++
+		d.mu.Unlock()
+		return nil, false
+	}
+	d.mu.Unlock()
+
+	entry, err := d.read(name, key)
+	if err != nil || entry.Expired(d.now()) {
+		if err != nil && !os.IsNotExist(err) {
+			slog.Error("disk cache read failed", "error", err)
+		}
+
+		d.mu.Lock()
+		if d.files[name] == element {
+			d.remove(element)
+		}
+		if err == nil {
+			d.expirations++
+		}
+		d.misses++
+		d.mu.Unlock()
+		return nil, false
+	}
+
+	now := d.now()
+	d.mu.Lock()
+	if d.files[name] == element {
+		element.Value.(*diskFile).atime = now
+		d.lru.MoveToFront(element)
+	}
+	d.hits++
+	d.mu.Unlock()
+
+	// Record the access on the file itself, so the order survives a restart.
+	if info, err := os.Stat(d.path(name)); err == nil {
+		_ = os.Chtimes(d.path(name), now, info.ModTime())
+	}
+
+	return entry, true
+}
+
+// Set writes entry to disk under key, evicting the least recently accessed files to make
+// room. Entries larger than the whole cache are not stored.
+func (d *Disk) Set(ctx context.Context, key string, entry *Entry) {
+	if entry.Size() > d.maxBytes || entry.Expired(d.now()) {
+		return
+	}
+
+	name := fileName(key)
+	size, err := d.write(name, key, entry)
+	if err != nil {
+		slog.Error("disk cache write failed", "error", err)
+		return
+	}
+
+	if size > d.maxBytes {
+		_ = os.Remove(d.path(name))
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if element, ok := d.files[name]; ok {
+		d.lru.Remove(element)
+		d.size -= element.Value.(*diskFile).size
+	}
+
+	d.files[name] = d.lru.PushFront(&diskFile{name: name, size: size, atime: d.now()})
+	d.size += size
+
+	d.evict()
+}
+
+// Remove deletes the entry for key, returning whether there was one.
+func (d *Disk) Remove(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	element, ok := d.files[fileName(key)]
+	if ok {
+		d.remove(element)
+	}
+
+	return ok
+}
+
+// PurgeSource evicts every entry made from the source image URL, returning how many. The
+// source is recorded in each file, so every file is read.
+func (d *Disk) PurgeSource(ctx context.Context, source string) (int, error) {
+	d.mu.Lock()
+	names := make([]string, 0, len(d.files))
+	for name := range d.files {
+		names = append(names, name)
+	}
+	d.mu.Unlock()
+
+	purged := 0
+	for _, name := range names {
+		metadata, err := d.readMetadata(name)
+		if err != nil || metadata.Source != source {
+			continue
+		}
+
+		d.mu.Lock()
+		if element, ok := d.files[name]; ok {
+			d.remove(element)
+			purged++
+		}
+		d.mu.Unlock()
+	}
+
+	return purged, nil
+}
+
+// PurgeAll evicts every entry, returning how many.
+func (d *Disk) PurgeAll(ctx context.Context) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	purged := 0
+	for d.lru.Len() > 0 {
+		d.remove(d.lru.Back())
+		purged++
+	}
+
+	return purged, nil
+}
+
+// Stats returns the current state of the cache.
+func (d *Disk) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return Stats{
+		Entries:     len(d.files),
+		Bytes:       d.size,
+		MaxBytes:    d.maxBytes,
+		Hits:        d.hits,
+		Misses:      d.misses,
+		Evictions:   d.evictions,
+		Expirations: d.expirations,
+	}
+}
+
+// rebuild indexes the files already in the directory, oldest access first, and removes any
+// temporary files left behind by a crash.
+func (d *Disk) rebuild() error {
+	var found []*diskFile
+
+	err := filepath.WalkDir(d.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		if strings.HasPrefix(entry.Name(), tempPrefix) {
+			_ = os.Remove(path)
+			return nil
+		}
+
+		if !validFileName(entry.Name()) || filepath.Dir(path) != filepath.Dir(d.path(entry.Name())) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+
+		found = append(found, &diskFile{name: entry.Name(), size: info.Size(), atime: accessTime(info)})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].atime.Before(found[j].atime)
+	})
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, file := range found {
+		d.files[file.name] = d.lru.PushFront(file)
+		d.size += file.size
+	}
+
+	d.evict()
+
+	return nil
+}
+
+// readMetadata reads only the metadata line of a file.
+func (d *Disk) readMetadata(name string) (*entryMetadata, error) {
+	file, err := os.Open(d.path(name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata entryMetadata
+	if err := json.Unmarshal(line, &metadata); err != nil {
+		return nil, err
+	}
+
+	return &metadata, nil
+}
+
+func (d *Disk) read(name string, key string) (*Entry, error) {
+	data, err := os.ReadFile(d.path(name))
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeEntry(data, key)
+}
+
+// write stores the entry in a temporary file, then renames it into place.
+func (d *Disk) write(name string, key string, entry *Entry) (int64, error) {
+	path := d.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), tempPrefix+"*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	data, err := encodeEntry(key, entry)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		return 0, err
+	}
+
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+
+	if err := file.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(file.Name(), path); err != nil {
+		return 0, err
+	}
+
+	return int64(len(data)), nil
+}
+
+func (d *Disk) evict() {
+	for d.size > d.maxBytes && d.lru.Len() > 0 {
+		d.remove(d.lru.Back())
+		d.evictions++
+	}
+}
+
+func (d *Disk) remove(element *list.Element) {
+	file := d.lru.Remove(element).(*diskFile)
+	delete(d.files, file.name)
+	d.size -= file.size
+
+	_ = os.Remove(d.path(file.name))
+}
+
+// path spreads files over 256 directories, so no single directory gets too large.
+func (d *Disk) path(name string) string {
+	return filepath.Join(d.dir, name[:2], name)
+}
+
+func fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func validFileName(name string) bool {
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(name)
+
+	return err == nil
+}
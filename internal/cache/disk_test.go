@@ -0,0 +1,170 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskGetSet(t *testing.T) {
+	d, err := NewDisk(t.TempDir(), 1024*1024)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	_, ok := d.Get(ctx, "a")
+	assert.False(t, ok)
+
+	entry := newEntry("image", time.Minute)
+	entry.Headers = map[string]string{"ETag": "abc"}
+	d.Set(ctx, "a", entry)
+
+	cached, ok := d.Get(ctx, "a")
+	require.True(t, ok)
+	assert.Equal(t, []byte("image"), cached.Body)
+	assert.Equal(t, "jpeg", cached.Format)
+	assert.Equal(t, "abc", cached.Headers["ETag"])
+	assert.WithinDuration(t, entry.Expires, cached.Expires, time.Millisecond)
+
+	stats := d.Stats()
+	assert.Equal(t, 1, stats.Entries)
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+}
+
+func TestDiskEvictsLeastRecentlyAccessed(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	d, err := NewDisk(dir, 1024*1024)
+	require.NoError(t, err)
+
+	d.Set(ctx, "a", newEntry(strings.Repeat("x", 512), time.Minute))
+	fileSize := d.Stats().Bytes
+
+	// Timestamps in the metadata vary slightly in length, so allow some slack.
+	d, err = NewDisk(dir, 3*fileSize+64)
+	require.NoError(t, err)
+
+	d.Set(ctx, "b", newEntry(strings.Repeat("x", 512), time.Minute))
+	d.Set(ctx, "c", newEntry(strings.Repeat("x", 512), time.Minute))
+
+	// Use "a", making "b" the least recently accessed.
+	_, ok := d.Get(ctx, "a")
+	require.True(t, ok)
+
+	d.Set(ctx, "d", newEntry(strings.Repeat("x", 512), time.Minute))
+
+	_, ok = d.Get(ctx, "b")
+	assert.False(t, ok)
+	assert.NoFileExists(t, d.path(fileName("b")))
+
+	for _, key := range []string{"a", "c", "d"} {
+		_, ok := d.Get(ctx, key)
+		assert.True(t, ok, key)
+	}
+
+	assert.Equal(t, int64(1), d.Stats().Evictions)
+}
+
+func TestDiskRebuildsIndex(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	d, err := NewDisk(dir, 1024*1024)
+	require.NoError(t, err)
+
+	d.Set(ctx, "a", newEntry("first", time.Minute))
+	d.Set(ctx, "b", newEntry("second", time.Minute))
+
+	// Leftovers from a crash mid-write, and files that aren't ours, are ignored.
+	tempFile := filepath.Join(filepath.Dir(d.path(fileName("a"))), tempPrefix+"123")
+	require.NoError(t, os.WriteFile(tempFile, []byte("partial"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("hello"), 0o644))
+
+	restarted, err := NewDisk(dir, 1024*1024)
+	require.NoError(t, err)
+
+	assert.Equal(t, d.Stats().Bytes, restarted.Stats().Bytes)
+	assert.Equal(t, 2, restarted.Stats().Entries)
+	assert.NoFileExists(t, tempFile)
+
+	entry, ok := restarted.Get(ctx, "b")
+	require.True(t, ok)
+	assert.Equal(t, []byte("second"), entry.Body)
+}
+
+func TestDiskRebuildEvictsOldestFirst(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	d, err := NewDisk(dir, 1024*1024)
+	require.NoError(t, err)
+
+	d.Set(ctx, "a", newEntry(strings.Repeat("x", 512), time.Minute))
+	d.Set(ctx, "b", newEntry(strings.Repeat("x", 512), time.Minute))
+	totalSize := d.Stats().Bytes
+
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(d.path(fileName("a")), old, old))
+
+	// Only room for one of the files.
+	restarted, err := NewDisk(dir, totalSize-1)
+	require.NoError(t, err)
+
+	_, ok := restarted.Get(ctx, "a")
+	assert.False(t, ok)
+	_, ok = restarted.Get(ctx, "b")
+	assert.True(t, ok)
+}
+
+func TestDiskExpires(t *testing.T) {
+	d, err := NewDisk(t.TempDir(), 1024*1024)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	now := time.Now()
+	d.now = func() time.Time { return now }
+
+	d.Set(ctx, "a", newEntry("image", time.Minute))
+
+	now = now.Add(2 * time.Minute)
+	_, ok := d.Get(ctx, "a")
+	assert.False(t, ok)
+
+	stats := d.Stats()
+	assert.Equal(t, 0, stats.Entries)
+	assert.Equal(t, int64(1), stats.Expirations)
+	assert.NoFileExists(t, d.path(fileName("a")))
+}
+
+func TestDiskPurge(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	d, err := NewDisk(dir, 1024*1024)
+	require.NoError(t, err)
+
+	for key, source := range map[string]string{"a": "https://example.com/a", "b": "https://example.com/a", "c": "https://example.com/c"} {
+		entry := newEntry("image", time.Minute)
+		entry.Source = source
+		d.Set(ctx, key, entry)
+	}
+
+	assert.Equal(t, 2, purged(d.PurgeSource(ctx, "https://example.com/a")))
+	assert.NoFileExists(t, d.path(fileName("a")))
+	assert.NoFileExists(t, d.path(fileName("b")))
+
+	entry, ok := d.Get(ctx, "c")
+	require.True(t, ok)
+	assert.Equal(t, "https://example.com/c", entry.Source)
+
+	assert.Equal(t, 1, purged(d.PurgeAll(ctx)))
+	assert.NoFileExists(t, d.path(fileName("c")))
+	assert.Equal(t, int64(0), d.Stats().Bytes)
+}
@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+// entryMetadata is stored as the first line of an encoded entry, followed by the body.
+type entryMetadata struct {
+	Key     string            `json:"key"`
+	Format  string            `json:"format"`
+	Headers map[string]string `json:"headers"`
+	Source  string            `json:"source,omitempty"`
+	Created time.Time         `json:"created"`
+	Expires time.Time         `json:"expires"`
+}
+
+// encodeEntry serializes an entry for the disk and bucket caches. The key is stored with it, to
+// detect hash collisions and files that aren't ours.
+func encodeEntry(key string, entry *Entry) ([]byte, error) {
+	metadata, err := json.Marshal(entryMetadata{
+		Key:     key,
+		Format:  entry.Format,
+		Headers: entry.Headers,
+		Source:  entry.Source,
+		Created: entry.Created,
+		Expires: entry.Expires,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, len(metadata)+1+len(entry.Body))
+	data = append(data, metadata...)
+	data = append(data, '\n')
+	data = append(data, entry.Body...)
+
+	return data, nil
+}
+
+// decodeEntry reads an entry written by encodeEntry, failing with os.ErrNotExist if it was
+// stored under a different key.
+func decodeEntry(data []byte, key string) (*Entry, error) {
+	metadata, err := decodeMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+	_, body, _ := bytes.Cut(data, []byte("\n"))
+
+	if metadata.Key != key {
+		return nil, os.ErrNotExist
+	}
+
+	return &Entry{
+		Format:  metadata.Format,
+		Body:    body,
+		Headers: metadata.Headers,
+		Source:  metadata.Source,
+		Created: metadata.Created,
+		Expires: metadata.Expires,
+	}, nil
+}
+
+// decodeMetadata decodes the metadata line of an encoded entry, without the image.
+func decodeMetadata(data []byte) (entryMetadata, error) {
+	line, _, ok := bytes.Cut(data, []byte("\n"))
+	if !ok {
+		return entryMetadata{}, io.ErrUnexpectedEOF
+	}
+
+	var metadata entryMetadata
+	err := json.Unmarshal(line, &metadata)
+
+	return metadata, err
+}
@@ -0,0 +1,153 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// Memory is an in-memory cache, evicting the least recently used entries once it holds more
+// than its maximum size.
+type Memory struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	lru      *list.List // Most recently used at the front.
+	items    map[string]*list.Element
+	now      func() time.Time
+
+	hits        int64
+	misses      int64
+	evictions   int64
+	expirations int64
+}
+
+type memoryItem struct {
+	key   string
+	entry *Entry
+	size  int64
+}
+
+// NewMemory returns an in-memory cache holding up to maxBytes of entries.
+func NewMemory(maxBytes int64) *Memory {
+	return &Memory{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+		now:      time.Now,
+	}
+}
+
+// Get returns the entry for key, if it is cached and hasn't expired.
+func (m *Memory) Get(ctx context.Context, key string) (*Entry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	element, ok := m.items[key]
+	if !ok {
+		m.misses++
+		return nil, false
+	}
+
+	item := element.Value.(*memoryItem)
+	if item.entry.Expired(m.now()) {
+		m.remove(element)
+		m.expirations++
+		m.misses++
+		return nil, false
+	}
+
+	m.lru.MoveToFront(element)
+	m.hits++
+
+	return item.entry, true
+}
+
+// Set caches entry under key, evicting the least recently used entries to make room. Entries
+// larger than the whole cache are not stored.
+func (m *Memory) Set(ctx context.Context, key string, entry *Entry) {
+	size := entry.Size()
+	if size > m.maxBytes || entry.Expired(m.now()) {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if element, ok := m.items[key]; ok {
+		m.remove(element)
+	}
+
+	m.items[key] = m.lru.PushFront(&memoryItem{key: key, entry: entry, size: size})
+	m.size += size
+
+	for m.size > m.maxBytes {
+		m.remove(m.lru.Back())
+		m.evictions++
+	}
+}
+
+// Remove evicts the entry for key, returning whether there was one.
+func (m *Memory) Remove(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	element, ok := m.items[key]
+	if ok {
+		m.remove(element)
+	}
+
+	return ok
+}
+
+// PurgeSource evicts every entry made from the source image URL, returning how many.
+func (m *Memory) PurgeSource(ctx context.Context, source string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	purged := 0
+	for _, element := range m.items {
+		if element.Value.(*memoryItem).entry.Source == source {
+			m.remove(element)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+// PurgeAll evicts every entry, returning how many.
+func (m *Memory) PurgeAll(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	purged := len(m.items)
+	m.lru.Init()
+	m.items = make(map[string]*list.Element)
+	m.size = 0
+
+	return purged, nil
+}
+
+// Stats returns the current state of the cache.
+func (m *Memory) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return Stats{
+		Entries:     len(m.items),
+		Bytes:       m.size,
+		MaxBytes:    m.maxBytes,
+		Hits:        m.hits,
+		Misses:      m.misses,
+		Evictions:   m.evictions,
+		Expirations: m.expirations,
+	}
+}
+
+func (m *Memory) remove(element *list.Element) {
+	item := m.lru.Remove(element).(*memoryItem)
+	delete(m.items, item.key)
+	m.size -= item.size
+}
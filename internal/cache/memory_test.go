@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newEntry(body string, ttl time.Duration) *Entry {
+	return &Entry{
+		Format:  "jpeg",
+		Body:    []byte(body),
+		Created: time.Now(),
+		Expires: time.Now().Add(ttl),
+	}
+}
+
+func TestMemoryGetSet(t *testing.T) {
+	m := NewMemory(1024)
+	ctx := context.Background()
+
+	_, ok := m.Get(ctx, "a")
+	assert.False(t, ok)
+
+	m.Set(ctx, "a", newEntry("image", time.Minute))
+
+	entry, ok := m.Get(ctx, "a")
+	require.True(t, ok)
+	assert.Equal(t, []byte("image"), entry.Body)
+
+	stats := m.Stats()
+	assert.Equal(t, 1, stats.Entries)
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+	assert.Equal(t, entry.Size(), stats.Bytes)
+}
+
+func TestMemoryEvictsLeastRecentlyUsed(t *testing.T) {
+	entrySize := newEntry(strings.Repeat("x", 96), time.Minute).Size()
+	m := NewMemory(3 * entrySize)
+	ctx := context.Background()
+
+	m.Set(ctx, "a", newEntry(strings.Repeat("x", 96), time.Minute))
+	m.Set(ctx, "b", newEntry(strings.Repeat("x", 96), time.Minute))
+	m.Set(ctx, "c", newEntry(strings.Repeat("x", 96), time.Minute))
+
+	// Use "a", making "b" the least recently used.
+	_, ok := m.Get(ctx, "a")
+	require.True(t, ok)
+
+	m.Set(ctx, "d", newEntry(strings.Repeat("x", 96), time.Minute))
+
+	_, ok = m.Get(ctx, "b")
+	assert.False(t, ok)
+
+	for _, key := range []string{"a", "c", "d"} {
+		_, ok := m.Get(ctx, key)
+		assert.True(t, ok, key)
+	}
+
+	stats := m.Stats()
+	assert.Equal(t, 3, stats.Entries)
+	assert.Equal(t, int64(1), stats.Evictions)
+	assert.LessOrEqual(t, stats.Bytes, stats.MaxBytes)
+}
+
+func TestMemoryExpires(t *testing.T) {
+	m := NewMemory(1024)
+	ctx := context.Background()
+
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	m.Set(ctx, "a", newEntry("image", time.Minute))
+
+	now = now.Add(2 * time.Minute)
+	_, ok := m.Get(ctx, "a")
+	assert.False(t, ok)
+
+	stats := m.Stats()
+	assert.Equal(t, 0, stats.Entries)
+	assert.Equal(t, int64(0), stats.Bytes)
+	assert.Equal(t, int64(1), stats.Expirations)
+}
+
+func TestMemorySkipsOversizedAndExpiredEntries(t *testing.T) {
+	m := NewMemory(16)
+	ctx := context.Background()
+
+	m.Set(ctx, "large", newEntry(strings.Repeat("x", 64), time.Minute))
+	m.Set(ctx, "expired", newEntry("image", -time.Minute))
+
+	assert.Equal(t, 0, m.Stats().Entries)
+}
+
+func TestMemoryReplaceAndRemove(t *testing.T) {
+	m := NewMemory(1024)
+	ctx := context.Background()
+
+	m.Set(ctx, "a", newEntry("first", time.Minute))
+	m.Set(ctx, "a", newEntry("second", time.Minute))
+
+	entry, ok := m.Get(ctx, "a")
+	require.True(t, ok)
+	assert.Equal(t, []byte("second"), entry.Body)
+	assert.Equal(t, entry.Size(), m.Stats().Bytes)
+
+	assert.True(t, m.Remove("a"))
+	assert.False(t, m.Remove("a"))
+	assert.Equal(t, int64(0), m.Stats().Bytes)
+}
+
+func TestMemoryPurge(t *testing.T) {
+	m := NewMemory(1024)
+	ctx := context.Background()
+
+	for key, source := range map[string]string{"a": "https://example.com/a", "b": "https://example.com/a", "c": "https://example.com/c"} {
+		entry := newEntry("image", time.Minute)
+		entry.Source = source
+		m.Set(ctx, key, entry)
+	}
+
+	assert.Equal(t, 2, purged(m.PurgeSource(ctx, "https://example.com/a")))
+	assert.Equal(t, 0, purged(m.PurgeSource(ctx, "https://example.com/a")))
+
+	_, ok := m.Get(ctx, "a")
+	assert.False(t, ok)
+	_, ok = m.Get(ctx, "c")
+	assert.True(t, ok)
+
+	assert.Equal(t, 1, purged(m.PurgeAll(ctx)))
+	assert.Equal(t, 0, m.Stats().Entries)
+	assert.Equal(t, int64(0), m.Stats().Bytes)
+}
@@ -0,0 +1,200 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisRetryAfter is how long the Redis cache is skipped after a failure, so requests don't
+// each wait for Redis while it is down.
+const redisRetryAfter = time.Second
+
+// Redis is a cache in Redis, or any server speaking its protocol, shared by every instance of
+// the service.
+//
+// Entries are stored under the prefix, and expire in Redis along with the entry, so Redis
+// removes them on its own. Entries larger than the maximum object size aren't stored.
+//
+// The keys of the entries made from each source image are also kept in a set, which expires
+// with the last of them, so purges don't have to read the entries.
+type Redis struct {
+	client         redis.UniversalClient
+	prefix         string
+	maxObjectBytes int64
+	now            func() time.Time
+
+	mu          sync.Mutex
+	downUntil   time.Time
+	hits        int64
+	misses      int64
+	expirations int64
+	errors      int64
+}
+
+// NewRedis returns a cache storing entries of up to maxObjectBytes through client, under prefix.
+func NewRedis(client redis.UniversalClient, prefix string, maxObjectBytes int64) *Redis {
+	return &Redis{
+		client:         client,
+		prefix:         prefix,
+		maxObjectBytes: maxObjectBytes,
+		now:            time.Now,
+	}
+}
+
+// Get returns the entry for key, if it is in Redis and hasn't expired.
+func (r *Redis) Get(ctx context.Context, key string) (*Entry, bool) {
+	if r.down() {
+		r.count(&r.misses)
+		return nil, false
+	}
+
+	data, err := r.client.Get(ctx, r.prefix+key).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			r.failed(ctx, "read", err)
+		}
+
+		r.count(&r.misses)
+		return nil, false
+	}
+
+	entry, err := decodeEntry(data, key)
+	if err != nil {
+		r.count(&r.misses)
+		return nil, false
+	}
+
+	if entry.Expired(r.now()) {
+		r.count(&r.expirations)
+		r.count(&r.misses)
+		return nil, false
+	}
+
+	r.count(&r.hits)
+
+	return entry, true
+}
+
+// Set stores entry under key, expiring it in Redis when the entry expires.
+func (r *Redis) Set(ctx context.Context, key string, entry *Entry) {
+	ttl := entry.Expires.Sub(r.now())
+	if ttl <= 0 || entry.Size() > r.maxObjectBytes || r.down() {
+		return
+	}
+
+	data, err := encodeEntry(key, entry)
+	if err != nil {
+		r.failed(ctx, "write", err)
+		return
+	}
+
+	// The set's expiry is only ever extended, so it outlives every entry in it.
+	sourceKey := r.sourceKey(entry.Source)
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, r.prefix+key, data, ttl)
+		pipe.SAdd(ctx, sourceKey, r.prefix+key)
+		pipe.ExpireNX(ctx, sourceKey, ttl)
+		pipe.ExpireGT(ctx, sourceKey, ttl)
+		return nil
+	})
+	if err != nil {
+		r.failed(ctx, "write", err)
+	}
+}
+
+// PurgeSource deletes every entry made from the source image URL, returning how many.
+func (r *Redis) PurgeSource(ctx context.Context, source string) (int, error) {
+	return r.purge(ctx, r.sourceKey(source))
+}
+
+// PurgeAll deletes every entry under the prefix, returning how many. Keys that don't hold one
+// of our entries, i.e. those of another application sharing the database, are left alone.
+func (r *Redis) PurgeAll(ctx context.Context) (int, error) {
+	purged := 0
+	sourceKeys := r.client.Scan(ctx, 0, r.prefix+redisSourcePrefix+"*", 100).Iterator()
+	for sourceKeys.Next(ctx) {
+		deleted, err := r.purge(ctx, sourceKeys.Val())
+		purged += deleted
+		if err != nil {
+			return purged, err
+		}
+	}
+
+	return purged, sourceKeys.Err()
+}
+
+// purge deletes the entries in the set at sourceKey, and the set. Entries that have expired
+// are still in the set, but aren't counted.
+func (r *Redis) purge(ctx context.Context, sourceKey string) (int, error) {
+	keys, err := r.client.SMembers(ctx, sourceKey).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for chunk := range slices.Chunk(keys, 100) {
+		deleted, err := r.client.Del(ctx, chunk...).Result()
+		if err != nil {
+			return purged, err
+		}
+		purged += int(deleted)
+	}
+
+	return purged, r.client.Del(ctx, sourceKey).Err()
+}
+
+// redisSourcePrefix is the prefix, after the cache's, of the sets of keys made from each
+// source image.
+const redisSourcePrefix = "sources/"
+
+// sourceKey is the key of the set of keys made from source.
+func (r *Redis) sourceKey(source string) string {
+	return r.prefix + redisSourcePrefix + sourceHash(source)
+}
+
+// Stats returns the lookups made since startup. The size of the cache is tracked by Redis.
+func (r *Redis) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return Stats{
+		Hits:        r.hits,
+		Misses:      r.misses,
+		Expirations: r.expirations,
+		Errors:      r.errors,
+	}
+}
+
+func (r *Redis) down() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.now().Before(r.downUntil)
+}
+
+// failed records an error, and skips Redis for a while. Requests that were canceled don't count.
+func (r *Redis) failed(ctx context.Context, operation string, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	slog.Error("redis cache "+operation+" failed", "error", err)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.errors++
+	r.downUntil = r.now().Add(redisRetryAfter)
+}
+
+func (r *Redis) count(counter *int64) {
+	r.mu.Lock()
+	*counter++
+	r.mu.Unlock()
+}
@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRedis(t *testing.T, maxObjectBytes int64) (*Redis, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+
+	return NewRedis(client, "dims:", maxObjectBytes), server
+}
+
+func TestRedisGetSet(t *testing.T) {
+	r, server := newTestRedis(t, 1024)
+	ctx := context.Background()
+
+	_, ok := r.Get(ctx, "render:webp:abc")
+	assert.False(t, ok)
+
+	entry := newEntry("image", time.Minute)
+	entry.Headers = map[string]string{"ETag": "abc"}
+	r.Set(ctx, "render:webp:abc", entry)
+
+	assert.True(t, server.Exists("dims:render:webp:abc"))
+	assert.InDelta(t, time.Minute, server.TTL("dims:render:webp:abc"), float64(time.Second))
+
+	cached, ok := r.Get(ctx, "render:webp:abc")
+	require.True(t, ok)
+	assert.Equal(t, []byte("image"), cached.Body)
+	assert.Equal(t, "abc", cached.Headers["ETag"])
+
+	stats := r.Stats()
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+}
+
+func TestRedisMaxObjectSize(t *testing.T) {
+	r, server := newTestRedis(t, 1024)
+	ctx := context.Background()
+
+	r.Set(ctx, "a", newEntry(strings.Repeat("x", 2048), time.Minute))
+	assert.False(t, server.Exists("dims:a"))
+}
+
+func TestRedisExpires(t *testing.T) {
+	r, server := newTestRedis(t, 1024)
+	ctx := context.Background()
+
+	r.Set(ctx, "a", newEntry("image", time.Minute))
+	server.FastForward(2 * time.Minute)
+
+	_, ok := r.Get(ctx, "a")
+	assert.False(t, ok)
+}
+
+func TestRedisFailsOpen(t *testing.T) {
+	r, server := newTestRedis(t, 1024)
+	ctx := context.Background()
+
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	server.Close()
+
+	r.Set(ctx, "a", newEntry("image", 2*time.Minute))
+	_, ok := r.Get(ctx, "a")
+	assert.False(t, ok)
+	assert.Equal(t, int64(1), r.Stats().Errors, "Redis is skipped after a failure")
+
+	require.NoError(t, server.Restart())
+	now = now.Add(time.Minute)
+
+	r.Set(ctx, "a", newEntry("image", 2*time.Minute))
+	_, ok = r.Get(ctx, "a")
+	assert.True(t, ok, "Redis is used again once it is back")
+}
+
+func TestRedisPurge(t *testing.T) {
+	r, server := newTestRedis(t, 1024)
+	ctx := context.Background()
+
+	for key, source := range map[string]string{"render:webp:a": "https://example.com/a", "render:png:b": "https://example.com/a", "render:webp:c": "https://example.com/c"} {
+		entry := newEntry("image", time.Minute)
+		entry.Source = source
+		r.Set(ctx, key, entry)
+	}
+
+	// Keys that aren't entries, or are outside the prefix, aren't touched.
+	require.NoError(t, server.Set("dims:other", "not an entry"))
+	require.NoError(t, server.Set("other:render:webp:a", "other"))
+
+	// An entry that expired is still in its source's set, but isn't counted.
+	expired := newEntry("image", time.Minute)
+	expired.Source = "https://example.com/a"
+	r.Set(ctx, "render:jpeg:d", expired)
+	server.Del("dims:render:jpeg:d")
+
+	purged, err := r.PurgeSource(ctx, "https://example.com/a")
+	require.NoError(t, err)
+	assert.Equal(t, 2, purged)
+
+	assert.False(t, server.Exists("dims:render:webp:a"))
+	assert.False(t, server.Exists("dims:render:png:b"))
+	assert.True(t, server.Exists("dims:render:webp:c"))
+
+	purged, err = r.PurgeAll(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	assert.ElementsMatch(t, []string{"dims:other", "other:render:webp:a"}, server.Keys())
+
+	server.Close()
+	_, err = r.PurgeAll(ctx)
+	assert.Error(t, err, "a failed purge is reported")
+}
+
+func TestRedisSourceKeys(t *testing.T) {
+	r, server := newTestRedis(t, 1024)
+	ctx := context.Background()
+
+	for key, ttl := range map[string]time.Duration{"render:webp:a": time.Hour, "render:png:a": time.Minute} {
+		entry := newEntry("image", ttl)
+		entry.Source = "https://example.com/a"
+		r.Set(ctx, key, entry)
+	}
+
+	// Purges read the keys from the set, which lasts as long as the longest-lived entry.
+	sourceKey := r.sourceKey("https://example.com/a")
+	members, err := server.Members(sourceKey)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"dims:render:webp:a", "dims:render:png:a"}, members)
+	assert.InDelta(t, time.Hour.Seconds(), server.TTL(sourceKey).Seconds(), 1)
+}
@@ -0,0 +1,117 @@
+// Package cachecontrol interprets the caching headers sent by origins with source images.
+package cachecontrol
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Directives are the Cache-Control directives that go-dims understands. Ages are -1 when the
+// directive is missing or invalid.
+type Directives struct {
+	MaxAge  int
+	SMaxAge int
+	NoStore bool
+	NoCache bool
+	Private bool
+	Public  bool
+}
+
+// Parse reads the directives from a Cache-Control header. Directive names are case-insensitive,
+// unknown directives are ignored, and so are ages that aren't a non-negative number.
+func Parse(header string) Directives {
+	directives := Directives{MaxAge: -1, SMaxAge: -1}
+
+	for _, directive := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "max-age":
+			directives.MaxAge = parseAge(value)
+		case "s-maxage":
+			directives.SMaxAge = parseAge(value)
+		case "no-store":
+			directives.NoStore = true
+		case "no-cache":
+			directives.NoCache = true
+		case "private":
+			directives.Private = true
+		case "public":
+			directives.Public = true
+		}
+	}
+
+	return directives
+}
+
+func parseAge(value string) int {
+	age, err := strconv.Atoi(value)
+	if err != nil || age < 0 {
+		return -1
+	}
+
+	return age
+}
+
+// Origin is how an origin allows its image, and so the images rendered from it, to be cached.
+type Origin struct {
+	TTL     int  // Seconds the image may be cached for, by shared caches unless Private is set.
+	NoStore bool // The image must not be cached at all.
+	NoCache bool // The image must be revalidated before each use.
+	Private bool // The image may only be cached by the client, for TTL seconds.
+}
+
+// FromHeaders interprets an origin's Cache-Control and Expires headers, returning false when
+// they don't restrict caching or say for how long the image may be cached.
+//
+// For shared caches s-maxage is preferred over max-age, and max-age over Expires, which is
+// relative to now. Private images ignore s-maxage, since it only applies to shared caches.
+func FromHeaders(cacheControl string, expires string, now time.Time) (Origin, bool) {
+	directives := Parse(cacheControl)
+
+	switch {
+	case directives.NoStore:
+		return Origin{NoStore: true}, true
+	case directives.NoCache:
+		return Origin{NoCache: true}, true
+	}
+
+	ttl := -1
+	if directives.SMaxAge >= 0 && !directives.Private {
+		ttl = directives.SMaxAge
+	} else if directives.MaxAge >= 0 {
+		ttl = directives.MaxAge
+	} else if expires != "" {
+		ttl = 0
+		if expiresAt, err := http.ParseTime(expires); err == nil && expiresAt.After(now) {
+			ttl = int(expiresAt.Sub(now).Seconds())
+		}
+	}
+
+	if directives.Private {
+		return Origin{TTL: max(ttl, 0), Private: true}, true
+	}
+
+	if ttl < 0 {
+		return Origin{}, false
+	}
+
+	return Origin{TTL: ttl}, true
+}
+
+// Clamp keeps ttl between minimum and maximum, each ignored when 0, the way the
+// DIMS_CACHE_CONTROL_MIN and DIMS_CACHE_CONTROL_MAX settings apply to origin TTLs.
+func Clamp(ttl int, minimum int, maximum int) int {
+	if minimum != 0 && ttl <= minimum {
+		ttl = minimum
+	}
+
+	if maximum != 0 && ttl >= maximum {
+		ttl = maximum
+	}
+
+	return ttl
+}
@@ -0,0 +1,129 @@
+package cachecontrol
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		header string
+		want   Directives
+	}{
+		{"", Directives{MaxAge: -1, SMaxAge: -1}},
+		{"max-age=60", Directives{MaxAge: 60, SMaxAge: -1}},
+		{"public, max-age=60, s-maxage=300", Directives{MaxAge: 60, SMaxAge: 300, Public: true}},
+		{"Max-Age=60", Directives{MaxAge: 60, SMaxAge: -1}},
+		{`max-age="60"`, Directives{MaxAge: 60, SMaxAge: -1}},
+		{"max-age = 60", Directives{MaxAge: 60, SMaxAge: -1}},
+		{"max-age=abc", Directives{MaxAge: -1, SMaxAge: -1}},
+		{"max-age=-5", Directives{MaxAge: -1, SMaxAge: -1}},
+		{"no-store", Directives{MaxAge: -1, SMaxAge: -1, NoStore: true}},
+		{"no-cache, max-age=0", Directives{MaxAge: 0, SMaxAge: -1, NoCache: true}},
+		{`private="Set-Cookie", max-age=10`, Directives{MaxAge: 10, SMaxAge: -1, Private: true}},
+		{"community=UCI, max-age=5", Directives{MaxAge: 5, SMaxAge: -1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			assert.Equal(t, tt.want, Parse(tt.header))
+		})
+	}
+}
+
+func TestFromHeaders(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	inAnHour := now.Add(time.Hour).Format(http.TimeFormat)
+	anHourAgo := now.Add(-time.Hour).Format(http.TimeFormat)
+
+	tests := []struct {
+		name         string
+		cacheControl string
+		expires      string
+		want         Origin
+		ok           bool
+	}{
+		{"no headers", "", "", Origin{}, false},
+		{"no lifetime", "public", "", Origin{}, false},
+		{"max-age", "public, max-age=60", "", Origin{TTL: 60}, true},
+		{"max-age zero", "max-age=0", "", Origin{TTL: 0}, true},
+		{"s-maxage preferred", "max-age=60, s-maxage=600", "", Origin{TTL: 600}, true},
+		{"s-maxage only", "s-maxage=600", "", Origin{TTL: 600}, true},
+		{"max-age over expires", "max-age=60", inAnHour, Origin{TTL: 60}, true},
+		{"expires", "", inAnHour, Origin{TTL: 3600}, true},
+		{"expires in the past", "", anHourAgo, Origin{TTL: 0}, true},
+		{"invalid expires", "", "0", Origin{TTL: 0}, true},
+		{"no-store", "no-store, max-age=60", inAnHour, Origin{NoStore: true}, true},
+		{"no-cache", "no-cache", "", Origin{NoCache: true}, true},
+		{"no-store over no-cache", "no-cache, no-store", "", Origin{NoStore: true}, true},
+		{"private", "private, max-age=60", "", Origin{TTL: 60, Private: true}, true},
+		{"private ignores s-maxage", "private, max-age=60, s-maxage=600", "", Origin{TTL: 60, Private: true}, true},
+		{"private with expires", "private", inAnHour, Origin{TTL: 3600, Private: true}, true},
+		{"private without lifetime", "private", "", Origin{Private: true}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := FromHeaders(tt.cacheControl, tt.expires, now)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestClamp(t *testing.T) {
+	tests := []struct {
+		ttl     int
+		minimum int
+		maximum int
+		want    int
+	}{
+		{60, 0, 0, 60},
+		{60, 120, 0, 120},
+		{0, 120, 0, 120},
+		{600, 0, 300, 300},
+		{60, 30, 300, 60},
+		{600, 30, 300, 300},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, Clamp(tt.ttl, tt.minimum, tt.maximum), "Clamp(%d, %d, %d)", tt.ttl, tt.minimum, tt.maximum)
+	}
+}
+
+func TestHeader(t *testing.T) {
+	tests := []struct {
+		header Header
+		want   string
+	}{
+		{Header{MaxAge: 60}, "max-age=60, public"},
+		{Header{MaxAge: 60, SharedMaxAge: 3600}, "max-age=60, s-maxage=3600, public"},
+		{Header{MaxAge: 0, SharedMaxAge: 3600}, "max-age=0, s-maxage=3600, public"},
+		{Header{MaxAge: 60, StaleWhileRevalidate: 30, StaleIfError: 600}, "max-age=60, public, stale-while-revalidate=30, stale-if-error=600"},
+		{Header{MaxAge: 31536000, Immutable: true}, "max-age=31536000, public, immutable"},
+		{Header{MaxAge: 60, SharedMaxAge: 3600, Private: true}, "max-age=60, private"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.header.String())
+	}
+}
+
+func TestHeaderTargeted(t *testing.T) {
+	tests := []struct {
+		header Header
+		want   string
+	}{
+		{Header{MaxAge: 60}, "max-age=60"},
+		{Header{MaxAge: 60, SharedMaxAge: 3600, Immutable: true}, "max-age=3600"},
+		{Header{MaxAge: 60, Private: true}, "max-age=60"},
+		{Header{MaxAge: 60, StaleWhileRevalidate: 30, StaleIfError: 600}, "max-age=60, stale-while-revalidate=30, stale-if-error=600"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.header.Targeted())
+	}
+}
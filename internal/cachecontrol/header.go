@@ -0,0 +1,68 @@
+package cachecontrol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Header is a Cache-Control header sent with an image. Ages of 0, other than max-age, are left
+// out.
+type Header struct {
+	MaxAge               int  // How long browsers, and shared caches without SharedMaxAge, may keep the image.
+	SharedMaxAge         int  // How long shared caches, i.e. CDNs, may keep the image (s-maxage).
+	StaleWhileRevalidate int  // How long a stale image may be served while it is revalidated.
+	StaleIfError         int  // How long a stale image may be served when revalidating fails.
+	Immutable            bool // The image never changes, so browsers needn't revalidate it.
+	Private              bool // Only browsers may keep the image.
+}
+
+// String formats the header, i.e. "max-age=60, s-maxage=3600, public, stale-if-error=600".
+func (h Header) String() string {
+	directives := []string{fmt.Sprintf("max-age=%d", h.MaxAge)}
+
+	if h.Private {
+		directives = append(directives, "private")
+	} else {
+		if h.SharedMaxAge > 0 {
+			directives = append(directives, fmt.Sprintf("s-maxage=%d", h.SharedMaxAge))
+		}
+
+		directives = append(directives, "public")
+	}
+
+	directives = append(directives, h.staleDirectives()...)
+
+	if h.Immutable {
+		directives = append(directives, "immutable")
+	}
+
+	return strings.Join(directives, ", ")
+}
+
+// Targeted formats the header for Surrogate-Control and CDN-Cache-Control, which are only read by
+// CDNs. They hold the shared cache lifetime and the stale directives.
+func (h Header) Targeted() string {
+	maxAge := h.MaxAge
+	if h.SharedMaxAge > 0 {
+		maxAge = h.SharedMaxAge
+	}
+
+	directives := []string{fmt.Sprintf("max-age=%d", maxAge)}
+	directives = append(directives, h.staleDirectives()...)
+
+	return strings.Join(directives, ", ")
+}
+
+func (h Header) staleDirectives() []string {
+	var directives []string
+
+	if h.StaleWhileRevalidate > 0 {
+		directives = append(directives, fmt.Sprintf("stale-while-revalidate=%d", h.StaleWhileRevalidate))
+	}
+
+	if h.StaleIfError > 0 {
+		directives = append(directives, fmt.Sprintf("stale-if-error=%d", h.StaleIfError))
+	}
+
+	return directives
+}
@@ -0,0 +1,96 @@
+// Package coalesce shares the result of identical concurrent calls, so a burst of requests for
+// the same image only fetches and renders it once.
+package coalesce
+
+import (
+	"context"
+	"sync"
+)
+
+// Group runs at most one call per key at a time. Callers asking for a key while its call is
+// running wait for it and share its result, including any error.
+//
+// The call runs on a context detached from the callers, so one caller giving up doesn't fail
+// the others. It is only canceled once every caller has given up.
+//
+// The zero value is ready to use.
+type Group[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*call[T]
+}
+
+type call[T any] struct {
+	done    chan struct{}
+	value   T
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// Do runs fn for key, or waits for the call already running for key. It returns the result,
+// and whether it came from another caller's call.
+//
+// The context passed to fn keeps the values of ctx, i.e. the trace, but not its deadline or
+// cancellation, so fn must apply its own timeouts.
+func (g *Group[T]) Do(ctx context.Context, key string, fn func(ctx context.Context) (T, error)) (T, bool, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call[T])
+	}
+
+	c, shared := g.calls[key]
+	if shared {
+		c.waiters++
+	} else {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c = &call[T]{done: make(chan struct{}), waiters: 1, cancel: cancel}
+		g.calls[key] = c
+
+		go g.run(callCtx, key, c, fn)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.value, shared, c.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			// Nobody is waiting anymore, later callers start a new call.
+			c.cancel()
+			g.forget(key, c)
+		}
+		g.mu.Unlock()
+
+		var zero T
+		return zero, shared, ctx.Err()
+	}
+}
+
+// Running returns the number of calls in progress.
+func (g *Group[T]) Running() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return len(g.calls)
+}
+
+func (g *Group[T]) run(ctx context.Context, key string, c *call[T], fn func(ctx context.Context) (T, error)) {
+	defer c.cancel()
+
+	c.value, c.err = fn(ctx)
+
+	g.mu.Lock()
+	g.forget(key, c)
+	g.mu.Unlock()
+
+	close(c.done)
+}
+
+// forget removes the call for key, unless it has already been replaced. g.mu must be held.
+func (g *Group[T]) forget(key string, c *call[T]) {
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+}
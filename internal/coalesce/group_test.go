@@ -0,0 +1,163 @@
+package coalesce
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupSharesResult(t *testing.T) {
+	var group Group[string]
+	var calls atomic.Int32
+	release := make(chan struct{})
+
+	fn := func(ctx context.Context) (string, error) {
+		calls.Add(1)
+		<-release
+		return "image", nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]string, 10)
+	sharedCount := atomic.Int32{}
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, shared, err := group.Do(context.Background(), "key", fn)
+			assert.NoError(t, err)
+			if shared {
+				sharedCount.Add(1)
+			}
+			results[i] = value
+		}()
+	}
+
+	require.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, int32(len(results)-1), sharedCount.Load())
+	for _, value := range results {
+		assert.Equal(t, "image", value)
+	}
+	assert.Equal(t, 0, group.Running())
+}
+
+func TestGroupSharesError(t *testing.T) {
+	var group Group[int]
+	failure := errors.New("origin failed")
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	go func() {
+		_, _, _ = group.Do(context.Background(), "key", func(ctx context.Context) (int, error) {
+			close(started)
+			<-release
+			return 0, failure
+		})
+	}()
+	<-started
+
+	errs := make(chan error, 1)
+	go func() {
+		_, shared, err := group.Do(context.Background(), "key", func(ctx context.Context) (int, error) {
+			return 1, nil
+		})
+		assert.True(t, shared)
+		errs <- err
+	}()
+
+	require.Eventually(t, func() bool {
+		group.mu.Lock()
+		defer group.mu.Unlock()
+		return group.calls["key"] != nil && group.calls["key"].waiters == 2
+	}, time.Second, time.Millisecond)
+	close(release)
+
+	assert.ErrorIs(t, <-errs, failure)
+}
+
+func TestGroupWaiterCancellation(t *testing.T) {
+	var group Group[string]
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var workErr atomic.Value
+
+	fn := func(ctx context.Context) (string, error) {
+		close(started)
+		<-release
+		if err := ctx.Err(); err != nil {
+			workErr.Store(err)
+		}
+		return "image", nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, _, err := group.Do(ctx, "key", fn)
+		first <- err
+	}()
+	<-started
+
+	second := make(chan string, 1)
+	go func() {
+		value, _, err := group.Do(context.Background(), "key", fn)
+		assert.NoError(t, err)
+		second <- value
+	}()
+
+	require.Eventually(t, func() bool {
+		group.mu.Lock()
+		defer group.mu.Unlock()
+		return group.calls["key"].waiters == 2
+	}, time.Second, time.Millisecond)
+
+	// The caller that started the call gives up, the other keeps waiting for it.
+	cancel()
+	assert.ErrorIs(t, <-first, context.Canceled)
+
+	close(release)
+	assert.Equal(t, "image", <-second)
+	assert.Nil(t, workErr.Load())
+}
+
+func TestGroupCancelsAbandonedCall(t *testing.T) {
+	var group Group[string]
+	canceled := make(chan struct{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		_, _, _ = group.Do(ctx, "key", func(ctx context.Context) (string, error) {
+			<-ctx.Done()
+			close(canceled)
+			return "", ctx.Err()
+		})
+	}()
+
+	require.Eventually(t, func() bool { return group.Running() == 1 }, time.Second, time.Millisecond)
+	cancel()
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("abandoned call was not canceled")
+	}
+
+	// A new caller starts a new call, instead of joining the canceled one.
+	value, shared, err := group.Do(context.Background(), "key", func(ctx context.Context) (string, error) {
+		return "image", nil
+	})
+	require.NoError(t, err)
+	assert.False(t, shared)
+	assert.Equal(t, "image", value)
+}
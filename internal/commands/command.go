@@ -37,21 +37,39 @@ func PassThroughCommand(ctx context.Context, args string) error {
 }
 
 type RequestOperation struct {
-	URL    *url.URL    // The URL of the image being processed
-	Config core.Config // The global configuration.
+	Context      context.Context // The context of the client request.
+	URL          *url.URL        // The URL of the image being processed
+	Config       core.Config     // The global configuration.
+	Fetcher      *core.Fetcher   // Fetches other images used by the commands, i.e. watermarks.
+	SourceWidth  int             // The width of the source image, before it was shrunk on load.
+	SourceHeight int             // The height of the source image, before it was shrunk on load.
+}
+
+// sourceSize returns the size of the source image, or of image when it isn't known.
+func (data RequestOperation) sourceSize(image *vips.ImageRef) (float64, float64) {
+	if data.SourceWidth > 0 && data.SourceHeight > 0 {
+		return float64(data.SourceWidth), float64(data.SourceHeight)
+	}
+
+	return float64(image.Width()), float64(image.Height())
 }
 
 var VipsTransformCommands = map[string]VipsTransformOperation{
-	"crop":             CropCommand,
+	"crop":       CropCommand,
+	"sharpen":    SharpenCommand,
+	"brightness": BrightnessCommand,
+	"flipflop":   FlipFlopCommand,
+	"sepia":      SepiaCommand,
+	"grayscale":  GrayscaleCommand,
+	"autolevel":  AutolevelCommand,
+	"invert":     InvertCommand,
+	"rotate":     RotateCommand,
+}
+
+// VipsResizeCommands size the image within the configured output limits. Unlike the other
+// request commands they also run for error images.
+var VipsResizeCommands = map[string]VipsRequestOperation{
 	"resize":           ResizeCommand,
-	"sharpen":          SharpenCommand,
-	"brightness":       BrightnessCommand,
-	"flipflop":         FlipFlopCommand,
-	"sepia":            SepiaCommand,
-	"grayscale":        GrayscaleCommand,
-	"autolevel":        AutolevelCommand,
-	"invert":           InvertCommand,
-	"rotate":           RotateCommand,
 	"thumbnail":        ThumbnailCommand,
 	"legacy_thumbnail": LegacyThumbnailCommand,
 }
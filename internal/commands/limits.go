@@ -0,0 +1,54 @@
+package commands
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/beetlebugorg/go-dims/internal/core"
+)
+
+// limitOutputSize applies the configured output limits to the requested output size of a
+// resize or thumbnail.
+//
+// In "clamp" mode the size is scaled down, preserving the aspect ratio, until it fits within
+// the limits. Otherwise requests over the limits are rejected.
+func limitOutputSize(command string, args string, limits core.OutputLimits,
+	origWidth float64, origHeight float64, width float64, height float64) (float64, float64, error) {
+
+	scale := 1.0
+	if limits.MaxWidth > 0 && width > float64(limits.MaxWidth) {
+		scale = math.Min(scale, float64(limits.MaxWidth)/width)
+	}
+
+	if limits.MaxHeight > 0 && height > float64(limits.MaxHeight) {
+		scale = math.Min(scale, float64(limits.MaxHeight)/height)
+	}
+
+	if limits.MaxUpscale > 0 && origWidth > 0 && origHeight > 0 {
+		upscale := math.Max(width/origWidth, height/origHeight)
+		if upscale > limits.MaxUpscale {
+			scale = math.Min(scale, limits.MaxUpscale/upscale)
+		}
+	}
+
+	if scale >= 1 {
+		return width, height, nil
+	}
+
+	if limits.Mode != "clamp" {
+		return 0, 0, NewOperationError(command, args,
+			fmt.Sprintf("output size %dx%d exceeds the configured limits (max %dx%d, max upscale %.2f)",
+				int(width), int(height), limits.MaxWidth, limits.MaxHeight, limits.MaxUpscale))
+	}
+
+	return clampDimension(width, scale), clampDimension(height, scale), nil
+}
+
+// clampDimension scales down a dimension, leaving unset (zero) dimensions alone.
+func clampDimension(size float64, scale float64) float64 {
+	if size == 0 {
+		return 0
+	}
+
+	return math.Max(1, math.Floor(size*scale))
+}
@@ -0,0 +1,51 @@
+package commands
+
+import (
+	"testing"
+
+	"github.com/beetlebugorg/go-dims/internal/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimitOutputSize(t *testing.T) {
+	reject := core.OutputLimits{MaxWidth: 1000, MaxHeight: 800, Mode: "reject"}
+	clamp := core.OutputLimits{MaxWidth: 1000, MaxHeight: 800, Mode: "clamp"}
+	rejectUpscale := core.OutputLimits{MaxUpscale: 2, Mode: "reject"}
+	clampUpscale := core.OutputLimits{MaxUpscale: 2, Mode: "clamp"}
+
+	tests := []struct {
+		name           string
+		limits         core.OutputLimits
+		width, height  float64
+		expectedWidth  float64
+		expectedHeight float64
+		success        bool
+	}{
+		{"within limits", reject, 500, 400, 500, 400, true},
+		{"at limits", reject, 1000, 800, 1000, 800, true},
+		{"width over limit", reject, 1001, 400, 0, 0, false},
+		{"height over limit", reject, 500, 801, 0, 0, false},
+		{"upscale within limit", rejectUpscale, 2000, 100, 2000, 100, true},
+		{"upscale over limit", rejectUpscale, 2100, 100, 0, 0, false},
+		{"width clamped", clamp, 2000, 400, 1000, 200, true},
+		{"height clamped", clamp, 500, 1600, 250, 800, true},
+		{"upscale clamped", clampUpscale, 3000, 1000, 2000, 666, true},
+		{"unset width kept", clamp, 0, 1600, 0, 800, true},
+		{"no limits", core.OutputLimits{}, 99999, 99999, 99999, 99999, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			width, height, err := limitOutputSize("resize", "args", test.limits, 1000, 1000, test.width, test.height)
+			if !test.success {
+				var operationError *OperationError
+				assert.ErrorAs(t, err, &operationError)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedWidth, width)
+			assert.Equal(t, test.expectedHeight, height)
+		})
+	}
+}
@@ -5,15 +5,22 @@ import (
 	"github.com/davidbyttow/govips/v2/vips"
 )
 
-func ResizeCommand(image *vips.ImageRef, args string) error {
+func ResizeCommand(image *vips.ImageRef, args string, data RequestOperation) error {
 	geo, err := geometry.ParseGeometry(args)
 	if err != nil {
 		return NewOperationError("resize", args, err.Error())
 	}
 	rect := geo.ApplyMeta(image)
 
-	xr := float64(rect.Width) / float64(image.Width())
-	yr := float64(rect.Height) / float64(image.Height())
+	sourceWidth, sourceHeight := data.sourceSize(image)
+	width, height, err := limitOutputSize("resize", args, data.Config.OutputLimits,
+		sourceWidth, sourceHeight, rect.Width, rect.Height)
+	if err != nil {
+		return err
+	}
+
+	xr := width / float64(image.Width())
+	yr := height / float64(image.Height())
 
 	err = image.ResizeWithVScale(xr, yr, vips.KernelLanczos3)
 	if err != nil {
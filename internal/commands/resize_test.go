@@ -1,8 +1,11 @@
 package commands
 
 import (
+	"fmt"
+	"os"
 	"testing"
 
+	"github.com/beetlebugorg/go-dims/internal/core"
 	"github.com/davidbyttow/govips/v2/vips"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -15,7 +18,7 @@ func TestResize(t *testing.T) {
 	image, err := vips.NewImageFromFile(sourceImageDir + path)
 	require.NoError(t, err, "failed to load image: %s", path)
 
-	err = ResizeCommand(image, args)
+	err = ResizeCommand(image, args, RequestOperation{})
 	require.NoError(t, err, "failed to resize image: %s", path)
 
 	assert.Equal(t, image.Width(), 256)
@@ -29,7 +32,7 @@ func TestResizeOnlySmaller(t *testing.T) {
 	image, err := vips.NewImageFromFile(sourceImageDir + path)
 	require.NoError(t, err, "failed to load image: %s", path)
 
-	err = ResizeCommand(image, args)
+	err = ResizeCommand(image, args, RequestOperation{})
 	require.NoError(t, err, "failed to resize image: %s", path)
 
 	assert.Equal(t, image.Width(), 512)
@@ -43,7 +46,7 @@ func TestResizeOnlyLarger(t *testing.T) {
 	image, err := vips.NewImageFromFile(sourceImageDir + path)
 	require.NoError(t, err, "failed to load image: %s", path)
 
-	err = ResizeCommand(image, args)
+	err = ResizeCommand(image, args, RequestOperation{})
 	require.NoError(t, err, "failed to resize image: %s", path)
 
 	assert.Equal(t, image.Width(), 256)
@@ -58,7 +61,7 @@ func TestResizeMaintainAspectRatio(t *testing.T) {
 		t,
 		path,
 		func(img *vips.ImageRef) error {
-			return ResizeCommand(img, args)
+			return ResizeCommand(img, args, RequestOperation{})
 		},
 		func(img *vips.ImageRef) {
 			assert.Equal(t, 50, img.Width())
@@ -76,7 +79,7 @@ func TestResizeIgnoreAspectRatio(t *testing.T) {
 		t,
 		path,
 		func(img *vips.ImageRef) error {
-			return ResizeCommand(img, args)
+			return ResizeCommand(img, args, RequestOperation{})
 		},
 		func(img *vips.ImageRef) {
 			assert.Equal(t, 100, img.Width())
@@ -94,7 +97,7 @@ func TestResizeIgnoreAspectRatioWidthOnly(t *testing.T) {
 		t,
 		path,
 		func(img *vips.ImageRef) error {
-			return ResizeCommand(img, args)
+			return ResizeCommand(img, args, RequestOperation{})
 		},
 		func(img *vips.ImageRef) {
 			assert.Equal(t, 100, img.Width())
@@ -112,7 +115,7 @@ func TestResizeFill(t *testing.T) {
 		t,
 		path,
 		func(img *vips.ImageRef) error {
-			return ResizeCommand(img, args)
+			return ResizeCommand(img, args, RequestOperation{})
 		},
 		func(img *vips.ImageRef) {
 			assert.Equal(t, 100, img.Width())
@@ -131,7 +134,7 @@ func TestResizeFillWithCrop(t *testing.T) {
 		t,
 		path,
 		func(img *vips.ImageRef) error {
-			err := ResizeCommand(img, args)
+			err := ResizeCommand(img, args, RequestOperation{})
 			require.NoError(t, err, "failed to resize image: %s", path)
 
 			return CropCommand(img, cropsArgs)
@@ -143,3 +146,43 @@ func TestResizeFillWithCrop(t *testing.T) {
 		nil, // use default ExportNative
 	)
 }
+
+// A JPEG shrunk on load is limited by the size of the source image, not the shrunk image.
+func TestResizeShrinkOnLoadLimits(t *testing.T) {
+	path := "pexels-photo-1539116.jpeg"
+
+	buf, err := os.ReadFile(sourceImageDir + path)
+	require.NoError(t, err, "failed to read image: %s", path)
+
+	source, err := vips.NewImageFromBuffer(buf)
+	require.NoError(t, err, "failed to load image: %s", path)
+
+	importParams := vips.NewImportParams()
+	importParams.JpegShrinkFactor.Set(4)
+	image, err := vips.LoadImageFromBuffer(buf, importParams)
+	require.NoError(t, err, "failed to load image: %s", path)
+	require.Less(t, image.Width(), source.Width()/2, "the image wasn't shrunk on load")
+
+	// Half the source size is twice the size of the shrunk image.
+	width, height := source.Width()/2, source.Height()/2
+	args := fmt.Sprintf("%dx%d!", width, height)
+	data := RequestOperation{
+		Config:       core.Config{OutputLimits: core.OutputLimits{MaxUpscale: 1, Mode: "reject"}},
+		SourceWidth:  source.Width(),
+		SourceHeight: source.Height(),
+	}
+
+	err = ResizeCommand(image, args, data)
+	require.NoError(t, err, "failed to resize image: %s", path)
+
+	assert.Equal(t, width, image.Width())
+	assert.Equal(t, height, image.Height())
+
+	// Without the source size the shrunk image is upscaled past the limit.
+	image, err = vips.LoadImageFromBuffer(buf, importParams)
+	require.NoError(t, err, "failed to load image: %s", path)
+
+	data.SourceWidth, data.SourceHeight = 0, 0
+	var operationError *OperationError
+	assert.ErrorAs(t, ResizeCommand(image, args, data), &operationError)
+}
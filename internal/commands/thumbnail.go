@@ -5,23 +5,38 @@ import (
 	"github.com/davidbyttow/govips/v2/vips"
 )
 
-func ThumbnailCommand(image *vips.ImageRef, args string) error {
+func ThumbnailCommand(image *vips.ImageRef, args string, data RequestOperation) error {
 	rect, err := geometry.ParseGeometry(args)
 	if err != nil {
 		return NewOperationError("thumbnail", args, err.Error())
 	}
 
+	if rect.Flags.Force {
+		return ResizeCommand(image, args, data)
+	}
+
+	// Without a height the thumbnail keeps the aspect ratio of the image.
+	origWidth := float64(image.Width())
+	origHeight := float64(image.Height())
+	height := rect.Height
+	if height == 0 {
+		height = rect.Width * origHeight / origWidth
+	}
+
+	sourceWidth, sourceHeight := data.sourceSize(image)
+	width, height, err := limitOutputSize("thumbnail", args, data.Config.OutputLimits,
+		sourceWidth, sourceHeight, rect.Width, height)
+	if err != nil {
+		return err
+	}
+
 	cropMethod := vips.InterestingLow
 	if rect.Height == 0 {
 		cropMethod = vips.InterestingNone
-		rect.Height = 99999
-	}
-
-	if rect.Flags.Force {
-		return ResizeCommand(image, args)
+		height = 99999
 	}
 
-	err = image.Thumbnail(int(rect.Width), int(rect.Height), cropMethod)
+	err = image.Thumbnail(int(width), int(height), cropMethod)
 	if err != nil {
 		return NewOperationError("thumbnail", args, err.Error())
 	}
@@ -29,7 +44,7 @@ func ThumbnailCommand(image *vips.ImageRef, args string) error {
 	return nil
 }
 
-func LegacyThumbnailCommand(image *vips.ImageRef, args string) error {
+func LegacyThumbnailCommand(image *vips.ImageRef, args string, data RequestOperation) error {
 	rect, err := geometry.ParseGeometry(args)
 	if err != nil {
 		return NewOperationError("thumbnail", args, err.Error())
@@ -43,7 +58,14 @@ func LegacyThumbnailCommand(image *vips.ImageRef, args string) error {
 		rect.Height = cropRect.Height / 2
 	}
 
-	err = image.Thumbnail(int(rect.Width), int(rect.Height), cropMethod)
+	sourceWidth, sourceHeight := data.sourceSize(image)
+	width, height, err := limitOutputSize("legacy_thumbnail", args, data.Config.OutputLimits,
+		sourceWidth, sourceHeight, rect.Width, rect.Height)
+	if err != nil {
+		return err
+	}
+
+	err = image.Thumbnail(int(width), int(height), cropMethod)
 	if err != nil {
 		return NewOperationError("thumbnail", args, err.Error())
 	}
@@ -16,7 +16,7 @@ func TestThumbnail(t *testing.T) {
 		t,
 		path,
 		func(img *vips.ImageRef) error {
-			return ThumbnailCommand(img, args)
+			return ThumbnailCommand(img, args, RequestOperation{})
 		},
 		func(img *vips.ImageRef) {
 			assert.Equal(t, img.Width(), 256)
@@ -35,7 +35,7 @@ func TestThumbnailWithCrop(t *testing.T) {
 		t,
 		path,
 		func(img *vips.ImageRef) error {
-			return ThumbnailCommand(img, args)
+			return ThumbnailCommand(img, args, RequestOperation{})
 		},
 		func(img *vips.ImageRef) {
 			assert.Equal(t, img.Width(), 256)
@@ -54,7 +54,7 @@ func TestThumbnailWithoutHeight(t *testing.T) {
 		t,
 		path,
 		func(img *vips.ImageRef) error {
-			return ThumbnailCommand(img, args)
+			return ThumbnailCommand(img, args, RequestOperation{})
 		},
 		func(img *vips.ImageRef) {
 			assert.Equal(t, 32, img.Width())
@@ -73,7 +73,7 @@ func TestThumbnailIgnoreAspectRatio(t *testing.T) {
 		t,
 		path,
 		func(img *vips.ImageRef) error {
-			return ThumbnailCommand(img, args)
+			return ThumbnailCommand(img, args, RequestOperation{})
 		},
 		func(img *vips.ImageRef) {
 			assert.Equal(t, img.Width(), 256)
@@ -92,7 +92,7 @@ func TestLegacyThumbnail(t *testing.T) {
 		t,
 		path,
 		func(img *vips.ImageRef) error {
-			return LegacyThumbnailCommand(img, args)
+			return LegacyThumbnailCommand(img, args, RequestOperation{})
 		},
 		func(img *vips.ImageRef) {
 			assert.Equal(t, 256, img.Width())
@@ -110,7 +110,7 @@ func TestLegacyThumbnailWithoutHeight(t *testing.T) {
 		t,
 		path,
 		func(img *vips.ImageRef) error {
-			return LegacyThumbnailCommand(img, args)
+			return LegacyThumbnailCommand(img, args, RequestOperation{})
 		},
 		func(img *vips.ImageRef) {
 			assert.Equal(t, 32, img.Width())
@@ -1,6 +1,7 @@
 package commands
 
 import (
+	"context"
 	"fmt"
 	"github.com/beetlebugorg/go-dims/internal/core"
 	"math"
@@ -28,7 +29,16 @@ func Watermark(image *vips.ImageRef, args string, data RequestOperation) error {
 
 	// Download overlay image
 	timeout := time.Duration(data.Config.Timeout.Download) * time.Millisecond
-	overlayImageSource, err := core.FetchImage(url, timeout)
+	ctx := data.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if data.Fetcher == nil {
+		return NewOperationError("watermark", args, "no image source available")
+	}
+
+	overlayImageSource, err := data.Fetcher.FetchImage(ctx, url, timeout)
 	if err != nil {
 		return NewOperationError("watermark", args, err.Error())
 	}
@@ -38,6 +48,11 @@ func Watermark(image *vips.ImageRef, args string, data RequestOperation) error {
 		return NewOperationError("watermark", args, err.Error())
 	}
 
+	// The overlay is decoded lazily, so this rejects it before any pixels are decoded.
+	if err := core.CheckInputDimensions(data.Config.InputLimits, overlayImage.Width(), overlayImage.Height()); err != nil {
+		return err
+	}
+
 	// Resize image
 	if err := scaleOverlay(image, overlayImage, size); err != nil {
 		return NewOperationError("watermark", args, err.Error())
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"context"
+	"time"
+
+	"github.com/beetlebugorg/go-dims/internal/cache"
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// sourceKey is the cache key of a source image. It is the URL alone: the ETag isn't known
+// until the origin is asked, so it can't be part of the key. Instead the entry records the
+// ETag of the version that was fetched, and once stale it is revalidated with If-None-Match.
+// An origin that has a new version responds with it, and it replaces the entry.
+func sourceKey(imageSource string) string {
+	return "source:" + imageSource
+}
+
+// The source cache keeps fetched source images, so they aren't downloaded again for each
+// variant. Images are used as-is for DIMS_SOURCE_CACHE_TTL, then revalidated with the origin for
+// up to DIMS_SOURCE_CACHE_MAX_STALE longer. Images from the file backend are already local, and
+// aren't cached.
+
+// cachedSourceImage returns the cached source image, if any, and whether it is still fresh.
+// Stale images are returned so they can be revalidated with the origin.
+func (f *Fetcher) cachedSourceImage(ctx context.Context, sourceBackend SourceBackend, imageSource string) (*Image, bool) {
+	if f.cache == nil || sourceBackend.Name() == "file" {
+		return nil, false
+	}
+
+	entry, ok := f.cache.Get(ctx, sourceKey(imageSource))
+	if !ok {
+		return nil, false
+	}
+
+	image := &Image{
+		Bytes:        entry.Body,
+		Size:         len(entry.Body),
+		Format:       vips.DetermineImageType(entry.Body),
+		Status:       200,
+		CacheControl: entry.Headers["Cache-Control"],
+		EdgeControl:  entry.Headers["Edge-Control"],
+		Expires:      entry.Headers["Expires"],
+		LastModified: entry.Headers["Last-Modified"],
+		Etag:         entry.Headers["Etag"],
+	}
+
+	return image, time.Since(entry.Created) < f.ttl()
+}
+
+func (f *Fetcher) cacheSourceImage(ctx context.Context, sourceBackend SourceBackend, imageSource string, image *Image) {
+	if f.cache == nil || sourceBackend.Name() == "file" || image.Status != 200 || f.ttl() <= 0 {
+		return
+	}
+
+	// Images without an ETag or Last-Modified header can't be revalidated, so there's no
+	// point keeping them once they're stale.
+	expires := f.ttl()
+	if image.Etag != "" || image.LastModified != "" {
+		expires += time.Duration(f.cacheConfig.MaxStale) * time.Second
+	}
+
+	now := time.Now()
+	f.cache.Set(ctx, sourceKey(imageSource), &cache.Entry{
+		Format: vips.ImageTypes[image.Format],
+		Body:   image.Bytes,
+		Headers: map[string]string{
+			"Cache-Control": image.CacheControl,
+			"Edge-Control":  image.EdgeControl,
+			"Expires":       image.Expires,
+			"Last-Modified": image.LastModified,
+			"Etag":          image.Etag,
+		},
+		Source:  imageSource,
+		Created: now,
+		Expires: now.Add(expires),
+	})
+}
+
+// ttl is how long a cached source image is used without revalidating it.
+func (f *Fetcher) ttl() time.Duration {
+	return time.Duration(f.cacheConfig.TTL) * time.Second
+}
@@ -14,8 +14,72 @@ type OriginCacheControl struct {
 	Error     int  `env:"DIMS_CACHE_CONTROL_ERROR" envDefault:"60"`
 }
 
+type Server struct {
+	ReadHeaderTimeout int `env:"DIMS_READ_HEADER_TIMEOUT" envDefault:"5000"`
+	ReadTimeout       int `env:"DIMS_READ_TIMEOUT" envDefault:"10000"`
+	WriteTimeout      int `env:"DIMS_WRITE_TIMEOUT" envDefault:"30000"`
+	IdleTimeout       int `env:"DIMS_IDLE_TIMEOUT" envDefault:"60000"`
+	ShutdownDelay     int `env:"DIMS_SHUTDOWN_DELAY" envDefault:"5000"`
+	ShutdownTimeout   int `env:"DIMS_SHUTDOWN_TIMEOUT" envDefault:"20000"`
+}
+
+type Tracing struct {
+	Endpoint    string  `env:"DIMS_TRACING_ENDPOINT"` // OTLP/HTTP endpoint, tracing is disabled when empty.
+	ServiceName string  `env:"DIMS_TRACING_SERVICE_NAME" envDefault:"dims"`
+	SampleRatio float64 `env:"DIMS_TRACING_SAMPLE_RATIO" envDefault:"1"`
+}
+
+type Readiness struct {
+	CheckSources bool `env:"DIMS_READY_CHECK_SOURCES" envDefault:"false"`
+}
+
+// CacheControlDirectives are added to the Cache-Control header of images. The stale ages apply
+// to successful and error responses alike, unless overridden for one of them. Ages of -1 use the
+// global setting.
+type CacheControlDirectives struct {
+	BrowserMaxAge               int  `env:"DIMS_CACHE_CONTROL_BROWSER_MAX_AGE" envDefault:"-1"` // Moves the max-age to s-maxage when set.
+	StaleWhileRevalidate        int  `env:"DIMS_CACHE_CONTROL_STALE_WHILE_REVALIDATE" envDefault:"0"`
+	StaleIfError                int  `env:"DIMS_CACHE_CONTROL_STALE_IF_ERROR" envDefault:"0"`
+	Immutable                   bool `env:"DIMS_CACHE_CONTROL_IMMUTABLE" envDefault:"false"`
+	SuccessStaleWhileRevalidate int  `env:"DIMS_CACHE_CONTROL_SUCCESS_STALE_WHILE_REVALIDATE" envDefault:"-1"`
+	SuccessStaleIfError         int  `env:"DIMS_CACHE_CONTROL_SUCCESS_STALE_IF_ERROR" envDefault:"-1"`
+	ErrorStaleWhileRevalidate   int  `env:"DIMS_CACHE_CONTROL_ERROR_STALE_WHILE_REVALIDATE" envDefault:"-1"`
+	ErrorStaleIfError           int  `env:"DIMS_CACHE_CONTROL_ERROR_STALE_IF_ERROR" envDefault:"-1"`
+	ErrorImmutable              bool `env:"DIMS_CACHE_CONTROL_ERROR_IMMUTABLE" envDefault:"false"`
+}
+
+type Admin struct {
+	BindAddress string `env:"DIMS_ADMIN_BIND_ADDRESS"` // Disabled when empty.
+	Token       string `env:"DIMS_ADMIN_TOKEN"`        // Required by the admin endpoints.
+}
+
+type Peers struct {
+	Self             string   `env:"DIMS_PEERS_SELF"`                             // This instance's URL, i.e. http://10.0.0.1:8080.
+	List             []string `env:"DIMS_PEERS"`                                  // Static peer URLs, including this instance.
+	DNS              string   `env:"DIMS_PEERS_DNS"`                              // Host and port resolved to peers, i.e. dims-headless:8080.
+	RefreshInterval  int      `env:"DIMS_PEERS_REFRESH_INTERVAL" envDefault:"30"` // Seconds between DNS lookups.
+	HealthInterval   int      `env:"DIMS_PEERS_HEALTH_INTERVAL" envDefault:"5"`   // Seconds between health checks.
+	FailureThreshold int      `env:"DIMS_PEERS_FAILURE_THRESHOLD" envDefault:"3"` // Consecutive failures before ejecting a peer.
+	Timeout          int      `env:"DIMS_PEERS_TIMEOUT" envDefault:"15000"`       // Milliseconds to wait for a peer to render an image.
+	VirtualNodes     int      `env:"DIMS_PEERS_VIRTUAL_NODES" envDefault:"64"`    // Points on the hash ring per peer.
+	Secret           string   `env:"DIMS_PEERS_SECRET"`                           // Sent by peers to be handled locally.
+	MaxBytes         int64    `env:"DIMS_PEERS_MAX_BYTES" envDefault:"52428800"`  // Largest image accepted from a peer.
+}
+
+type Diagnostics struct {
+	ServerTiming bool `env:"DIMS_SERVER_TIMING" envDefault:"false"`
+	DebugHeaders bool `env:"DIMS_DEBUG_HEADERS" envDefault:"false"`
+}
+
 type EdgeControl struct {
-	DownstreamTtl int `env:"DIMS_EDGE_CONTROL_DOWNSTREAM_TTL" envDefault:"0"`
+	DownstreamTtl    int  `env:"DIMS_EDGE_CONTROL_DOWNSTREAM_TTL" envDefault:"0"`
+	SurrogateControl bool `env:"DIMS_SURROGATE_CONTROL" envDefault:"false"`
+	CDNCacheControl  bool `env:"DIMS_CDN_CACHE_CONTROL" envDefault:"false"`
+}
+
+type SurrogateKeys struct {
+	Header   string `env:"DIMS_SURROGATE_KEY_HEADER"` // i.e. Surrogate-Key or Cache-Tag, disabled when empty.
+	TagParam string `env:"DIMS_SURROGATE_KEY_TAG_PARAM" envDefault:"tag"`
 }
 
 type Error struct {
@@ -32,7 +96,59 @@ type OutputFormat struct {
 }
 
 type Timeout struct {
-	Download int `env:"DIMS_DOWNLOAD_TIMEOUT" envDefault:"3000"`
+	Download   int `env:"DIMS_DOWNLOAD_TIMEOUT" envDefault:"3000"`
+	Processing int `env:"DIMS_PROCESSING_TIMEOUT" envDefault:"10000"`
+}
+
+type InputLimits struct {
+	MaxWidth      int     `env:"DIMS_MAX_INPUT_WIDTH" envDefault:"16384"`
+	MaxHeight     int     `env:"DIMS_MAX_INPUT_HEIGHT" envDefault:"16384"`
+	MaxMegapixels float64 `env:"DIMS_MAX_INPUT_MEGAPIXELS" envDefault:"100"`
+}
+
+type OutputLimits struct {
+	MaxWidth   int     `env:"DIMS_MAX_OUTPUT_WIDTH" envDefault:"0"`  // Disabled when 0.
+	MaxHeight  int     `env:"DIMS_MAX_OUTPUT_HEIGHT" envDefault:"0"` // Disabled when 0.
+	MaxUpscale float64 `env:"DIMS_MAX_UPSCALE" envDefault:"0"`       // Disabled when 0.
+	Mode       string  `env:"DIMS_OUTPUT_LIMIT_MODE" envDefault:"reject"`
+}
+
+type Admission struct {
+	Capacity     int64 `env:"DIMS_ADMISSION_CAPACITY" envDefault:"250"`
+	MaxQueue     int   `env:"DIMS_ADMISSION_MAX_QUEUE" envDefault:"64"`
+	QueueTimeout int   `env:"DIMS_ADMISSION_QUEUE_TIMEOUT" envDefault:"1000"`
+	RetryAfter   int   `env:"DIMS_ADMISSION_RETRY_AFTER" envDefault:"1"`
+}
+
+type RenderCache struct {
+	MaxBytes int64 `env:"DIMS_RENDER_CACHE_MAX_BYTES" envDefault:"0"` // Disabled when 0.
+}
+
+type DiskCache struct {
+	Dir      string `env:"DIMS_DISK_CACHE_DIR"` // Disabled when empty.
+	MaxBytes int64  `env:"DIMS_DISK_CACHE_MAX_BYTES" envDefault:"1073741824"`
+}
+
+type BucketCache struct {
+	Bucket    string `env:"DIMS_BUCKET_CACHE_BUCKET"` // Disabled when empty.
+	Prefix    string `env:"DIMS_BUCKET_CACHE_PREFIX" envDefault:"dims/"`
+	Endpoint  string `env:"DIMS_BUCKET_CACHE_ENDPOINT"` // i.e. http://localhost:9000 for MinIO.
+	Region    string `env:"DIMS_BUCKET_CACHE_REGION"`
+	PathStyle bool   `env:"DIMS_BUCKET_CACHE_PATH_STYLE" envDefault:"false"`
+	Timeout   int    `env:"DIMS_BUCKET_CACHE_TIMEOUT" envDefault:"1000"` // Milliseconds.
+}
+
+type RedisCache struct {
+	URL            string `env:"DIMS_REDIS_CACHE_URL"` // Disabled when empty, i.e. redis://localhost:6379/0.
+	Prefix         string `env:"DIMS_REDIS_CACHE_PREFIX" envDefault:"dims:"`
+	MaxObjectBytes int64  `env:"DIMS_REDIS_CACHE_MAX_OBJECT_BYTES" envDefault:"1048576"`
+	Timeout        int    `env:"DIMS_REDIS_CACHE_TIMEOUT" envDefault:"100"` // Milliseconds.
+}
+
+type SourceCache struct {
+	MaxBytes int64 `env:"DIMS_SOURCE_CACHE_MAX_BYTES" envDefault:"0"`     // In-memory tier, disabled when 0.
+	TTL      int   `env:"DIMS_SOURCE_CACHE_TTL" envDefault:"300"`         // Seconds before revalidating with the origin.
+	MaxStale int   `env:"DIMS_SOURCE_CACHE_MAX_STALE" envDefault:"86400"` // Seconds to keep images for revalidation.
 }
 
 type Options struct {
@@ -70,8 +186,9 @@ type ImageOutputOptions struct {
 }
 
 type Source struct {
-	Default string   `env:"DIMS_DEFAULT_SOURCE_BACKEND" envDefault:"http"`
-	Allowed []string `env:"DIMS_ALLOWED_SOURCE_BACKENDS" envDefault:"http"`
+	Default  string   `env:"DIMS_DEFAULT_SOURCE_BACKEND" envDefault:"http"`
+	Allowed  []string `env:"DIMS_ALLOWED_SOURCE_BACKENDS" envDefault:"http"`
+	MaxBytes int64    `env:"DIMS_MAX_SOURCE_BYTES" envDefault:"52428800"`
 }
 
 type S3 struct {
@@ -80,25 +197,53 @@ type S3 struct {
 	Prefix string `env:"DIMS_S3_PREFIX" envDefault:""`
 }
 
+type HttpSource struct {
+	AllowedHosts         []string `env:"DIMS_HTTP_ALLOWED_HOSTS"`
+	DeniedHosts          []string `env:"DIMS_HTTP_DENIED_HOSTS"`
+	AllowPrivateNetworks bool     `env:"DIMS_HTTP_ALLOW_PRIVATE_NETWORKS" envDefault:"false"`
+	MaxRedirects         int      `env:"DIMS_HTTP_MAX_REDIRECTS" envDefault:"5"`
+	HealthCheckURL       string   `env:"DIMS_HTTP_HEALTH_CHECK_URL"`
+}
+
 type FileSource struct {
 	BaseDir string `env:"DIMS_FILE_BASE_DIR" envDefault:"./resources"`
 }
 
 type Config struct {
-	BindAddress     string `env:"DIMS_BIND_ADDRESS" envDefault:":8080"`
-	DevelopmentMode bool   `env:"DIMS_DEVELOPMENT_MODE" envDefault:"false"`
-	DebugMode       bool   `env:"DIMS_DEBUG_MODE" envDefault:"false"`
-	LogFormat       string `env:"DIMS_LOG_FORMAT" envDefault:"text"`
-	EtagAlgorithm   string
+	BindAddress        string `env:"DIMS_BIND_ADDRESS" envDefault:":8080"`
+	MetricsBindAddress string `env:"DIMS_METRICS_BIND_ADDRESS"` // Disabled when empty.
+	DevelopmentMode    bool   `env:"DIMS_DEVELOPMENT_MODE" envDefault:"false"`
+	DebugMode          bool   `env:"DIMS_DEBUG_MODE" envDefault:"false"`
+	LogFormat          string `env:"DIMS_LOG_FORMAT" envDefault:"text"`
+	AccessLog          bool   `env:"DIMS_ACCESS_LOG" envDefault:"true"`
+	EtagAlgorithm      string
 
+	Server
+	Admin
+	Peers
+	Tracing
+	Diagnostics
+	Readiness
 	Timeout
 	EdgeControl
+	SurrogateKeys
 	Signing
 	Error
 	OriginCacheControl
+	CacheControlDirectives
 	OutputFormat
 	Options
 	ImageOutputOptions
+	InputLimits
+	OutputLimits
+	Admission
+	RenderCache
+	DiskCache
+	RedisCache
+	BucketCache
+	SourceCache
+	Source
+	HttpSource
 }
 
 var config *Config
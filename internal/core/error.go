@@ -5,6 +5,7 @@ import "fmt"
 type StatusError struct {
 	StatusCode int
 	Message    string
+	RetryAfter int // Seconds the client should wait before retrying, sent as Retry-After if set.
 }
 
 func NewStatusError(statusCode int, message string) *StatusError {
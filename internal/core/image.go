@@ -1,10 +1,19 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/beetlebugorg/go-dims/internal/accesslog"
+	"github.com/beetlebugorg/go-dims/internal/cache"
+	"github.com/beetlebugorg/go-dims/internal/coalesce"
 	"github.com/beetlebugorg/go-dims/internal/gox/imagex/colorx"
-	"github.com/caarlos0/env/v10"
+	"github.com/beetlebugorg/go-dims/internal/metrics"
+	"github.com/beetlebugorg/go-dims/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/exp/slices"
+	"io"
 	"log/slog"
 	"time"
 
@@ -18,8 +27,27 @@ type Image struct {
 	Status       int            // The HTTP status code of the downloaded image.
 	CacheControl string         // The cache headers from the downloaded image.
 	EdgeControl  string         // The edge control headers from the downloaded image.
+	Expires      string         // The expires header from the downloaded image.
 	LastModified string         // The last modified header from the downloaded image.
 	Etag         string         // The etag header from the downloaded image.
+	Revalidated  bool           // The cached image was still current at the origin, and wasn't downloaded again.
+}
+
+// Revalidate returns the cached image for an origin that responded 304 Not Modified, keeping
+// its ETag and Last-Modified headers. Cache headers sent with the 304 replace the cached ones.
+func (image *Image) Revalidate(cacheControl string, edgeControl string) *Image {
+	revalidated := *image
+	revalidated.Revalidated = true
+
+	if cacheControl != "" {
+		revalidated.CacheControl = cacheControl
+	}
+
+	if edgeControl != "" {
+		revalidated.EdgeControl = edgeControl
+	}
+
+	return &revalidated
 }
 
 var ImageTypes = map[string]vips.ImageType{
@@ -37,36 +65,96 @@ var ImageTypes = map[string]vips.ImageType{
 type SourceBackend interface {
 	Name() string
 	CanHandle(imageSource string) bool
-	FetchImage(imageSource string, timeout time.Duration) (*Image, error)
+	FetchImage(ctx context.Context, imageSource string) (*Image, error)
+}
+
+// Revalidator is implemented by source backends that can make conditional requests, so that
+// an image that hasn't changed since it was cached isn't downloaded again.
+type Revalidator interface {
+	// RevalidateImage fetches the image, unless the origin reports that cached is still
+	// current, in which case it returns cached with Revalidated set.
+	RevalidateImage(ctx context.Context, imageSource string, cached *Image) (*Image, error)
 }
 
-var sourceBackends []SourceBackend
-var allSourceBackends []SourceBackend
-var defaultSourceBackend SourceBackend
+// HealthChecker is implemented by source backends that can check their dependencies are
+// reachable, i.e. that S3 credentials work, for the readiness probe.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// ErrHealthCheckSkipped is returned by backends that have nothing configured to check.
+var ErrHealthCheckSkipped = errors.New("skipped")
+
+// SourceBackendFactory builds a source backend from a fetcher's configuration.
+type SourceBackendFactory func(config Config) SourceBackend
 
+// sourceBackends are the registered source backends. Each fetcher builds them from its
+// configuration, and uses the ones it allows.
+var sourceBackends []SourceBackendFactory
+
+// RegisterImageBackend makes a source backend available to fetchers.
 func RegisterImageBackend(sourceBackend SourceBackend) {
-	config := Source{}
-	if err := env.Parse(&config); err != nil {
-		fmt.Printf("%+v\n", err)
+	RegisterSourceBackendFactory(func(Config) SourceBackend { return sourceBackend })
+}
+
+// RegisterSourceBackendFactory makes a source backend that depends on the configuration
+// available to fetchers.
+func RegisterSourceBackendFactory(factory SourceBackendFactory) {
+	sourceBackends = append(sourceBackends, factory)
+}
+
+// Fetcher fetches source images for one handler, through the source backends allowed by its
+// configuration. Fetched images are kept in its source cache, and concurrent fetches of the
+// same image share one download.
+type Fetcher struct {
+	config         Source
+	cacheConfig    SourceCache
+	cache          cache.Cache
+	backends       []SourceBackend
+	allowed        []SourceBackend
+	defaultBackend SourceBackend
+	fetches        coalesce.Group[fetchResult]
+}
+
+// NewFetcher returns a fetcher for the configuration, caching source images in sourceCache
+// unless it is nil.
+func NewFetcher(config Config, sourceCache cache.Cache) *Fetcher {
+	f := &Fetcher{
+		config:      config.Source,
+		cacheConfig: config.SourceCache,
+		cache:       sourceCache,
 	}
 
-	allSourceBackends = append(allSourceBackends, sourceBackend)
+	for _, factory := range sourceBackends {
+		sourceBackend := factory(config)
+		f.backends = append(f.backends, sourceBackend)
 
-	allowed := config.Allowed
+		if slices.Contains(config.Source.Allowed, sourceBackend.Name()) || config.Source.Default == sourceBackend.Name() {
+			slog.Debug("Registering image backend", "name", sourceBackend.Name())
+			f.allowed = append(f.allowed, sourceBackend)
+		} else {
+			slog.Debug("Image backend not registered", "name", sourceBackend.Name(), "reason", "not in allowed list")
+		}
 
-	if slices.Contains(allowed, sourceBackend.Name()) {
-		slog.Debug("Registering image backend", "name", sourceBackend.Name())
-		sourceBackends = append(sourceBackends, sourceBackend)
-	} else if config.Default == sourceBackend.Name() {
-		slog.Debug("Registering image backend", "name", sourceBackend.Name())
-		sourceBackends = append(sourceBackends, sourceBackend)
-	} else {
-		slog.Debug("Image backend not registered", "name", sourceBackend.Name(), "reason", "not in allowed list")
+		if sourceBackend.Name() == config.Source.Default {
+			f.defaultBackend = sourceBackend
+		}
 	}
 
-	if sourceBackend.Name() == config.Default {
-		defaultSourceBackend = sourceBackend
+	return f
+}
+
+// CheckSourceBackends runs the health check of every allowed source backend that has one,
+// returning the result by backend name.
+func (f *Fetcher) CheckSourceBackends(ctx context.Context) map[string]error {
+	results := make(map[string]error)
+	for _, sourceBackend := range f.allowed {
+		if checker, ok := sourceBackend.(HealthChecker); ok {
+			results[sourceBackend.Name()] = checker.CheckHealth(ctx)
+		}
 	}
+
+	return results
 }
 
 func ErrorImage(color string) (*vips.ImageRef, error) {
@@ -100,32 +188,198 @@ func ErrorImage(color string) (*vips.ImageRef, error) {
 	return errorImage, nil
 }
 
-func FetchImage(imageSource string, timeout time.Duration) (*Image, error) {
+type fetchResult struct {
+	image  *Image
+	cached bool
+}
+
+// FetchImage downloads the image using the first allowed source backend that can handle it.
+//
+// Concurrent calls for the same image source share one fetch, which is given at most timeout
+// to complete. It is abandoned once every client waiting for it has gone away.
+func (f *Fetcher) FetchImage(ctx context.Context, imageSource string, timeout time.Duration) (*Image, error) {
+	sourceBackend, err := f.findSourceBackend(imageSource)
+	if err != nil {
+		return nil, err
+	}
+
+	accesslog.SetSource(ctx, imageSource, sourceBackend.Name())
+
+	ctx, span := tracing.Tracer.Start(ctx, "fetch", trace.WithAttributes(
+		attribute.String("dims.source.backend", sourceBackend.Name()),
+		attribute.String("dims.source.url", imageSource),
+	))
+
+	// Concurrent requests for the same image share a single fetch.
+	fetched, shared, err := f.fetches.Do(ctx, imageSource, func(ctx context.Context) (fetchResult, error) {
+		cachedImage, fresh := f.cachedSourceImage(ctx, sourceBackend, imageSource)
+		if fresh {
+			return fetchResult{image: cachedImage, cached: true}, nil
+		}
+
+		image, err := f.fetchImage(ctx, sourceBackend, imageSource, timeout, cachedImage)
+		if err != nil {
+			return fetchResult{}, err
+		}
+
+		f.cacheSourceImage(ctx, sourceBackend, imageSource, image)
+
+		return fetchResult{image: image}, nil
+	})
+	if shared {
+		metrics.Coalesced.WithLabelValues("fetch").Inc()
+	}
+
+	image := fetched.image
+	if err == nil {
+		span.SetAttributes(
+			attribute.Bool("dims.source.cached", fetched.cached),
+			attribute.Bool("dims.source.shared", shared),
+			attribute.Bool("dims.source.revalidated", image.Revalidated),
+			attribute.Int("dims.source.size", len(image.Bytes)),
+			attribute.String("dims.source.format", vips.ImageTypes[image.Format]),
+		)
+	}
+	tracing.End(span, err)
+
+	return image, err
+}
+
+// fetchImage downloads the image, or revalidates the stale cached image with the origin if
+// there is one and the backend supports it.
+func (f *Fetcher) fetchImage(ctx context.Context, sourceBackend SourceBackend, imageSource string, timeout time.Duration, cached *Image) (*Image, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Backends read the image with ReadImage, which stops at the fetcher's maximum size.
+	ctx = context.WithValue(ctx, maxBytesKey{}, f.config.MaxBytes)
+
+	revalidator, revalidate := sourceBackend.(Revalidator)
+	revalidate = revalidate && cached != nil && (cached.Etag != "" || cached.LastModified != "")
+
+	start := time.Now()
+	var image *Image
+	var err error
+	if revalidate {
+		image, err = revalidator.RevalidateImage(ctx, imageSource, cached)
+	} else {
+		image, err = sourceBackend.FetchImage(ctx, imageSource)
+	}
+	metrics.SourceFetchDuration.WithLabelValues(sourceBackend.Name()).Observe(time.Since(start).Seconds())
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, NewStatusError(504, "Timeout fetching image: "+imageSource)
+		}
+
+		return nil, err
+	}
+
+	if revalidate {
+		result := "modified"
+		if image.Revalidated {
+			result = "not_modified"
+		}
+		metrics.SourceRevalidations.WithLabelValues(sourceBackend.Name(), result).Inc()
+
+		if image.Revalidated {
+			return image, nil
+		}
+	}
+
+	metrics.SourceBytes.WithLabelValues(sourceBackend.Name()).Observe(float64(len(image.Bytes)))
+
+	// Backends should stop reading early using ReadImage, this catches any that don't.
+	if maxBytes := f.config.MaxBytes; maxBytes > 0 && int64(len(image.Bytes)) > maxBytes {
+		return nil, sourceTooLargeError(int64(len(image.Bytes)), maxBytes)
+	}
+
+	return image, nil
+}
+
+func (f *Fetcher) findSourceBackend(imageSource string) (SourceBackend, error) {
 	// Check which source backend can handle the image source first, if
 	// none are found, use the default source backend.
-	for _, sourceBackend := range sourceBackends {
+	for _, sourceBackend := range f.allowed {
 		if sourceBackend.CanHandle(imageSource) {
-			return sourceBackend.FetchImage(imageSource, timeout)
+			return sourceBackend, nil
 		}
 	}
 
 	// If a default is set and another backend could have handled it but isn't
 	// allowed, don't use the default backend.
+	defaultSourceBackend := f.defaultBackend
 	if defaultSourceBackend != nil && defaultSourceBackend.Name() != "http" || defaultSourceBackend == nil {
-		for _, sourceBackend := range allSourceBackends {
-			if sourceBackend.CanHandle(imageSource) && sourceBackend.Name() != defaultSourceBackend.Name() {
+		for _, sourceBackend := range f.backends {
+			isDefault := defaultSourceBackend != nil && sourceBackend.Name() == defaultSourceBackend.Name()
+			if sourceBackend.CanHandle(imageSource) && !isDefault {
 				return nil, NewStatusError(400, "Supported image source '"+sourceBackend.Name()+
 					"' is not allowed: "+
 					imageSource)
 			}
 		}
 
-		return defaultSourceBackend.FetchImage(imageSource, timeout)
+		return defaultSourceBackend, nil
 	}
 
 	return nil, NewStatusError(400, "Unsupported image source: "+imageSource)
 }
 
+type maxBytesKey struct{}
+
+// ReadImage reads an image from a source backend, enforcing the DIMS_MAX_SOURCE_BYTES of the
+// fetcher that ctx comes from.
+//
+// The size is the length reported by the backend (i.e. Content-Length) or -1 if it is not
+// known. Images that report a size over the limit are rejected before reading anything,
+// otherwise reading stops as soon as the limit is exceeded.
+func ReadImage(ctx context.Context, body io.Reader, size int64) ([]byte, error) {
+	maxBytes, _ := ctx.Value(maxBytesKey{}).(int64)
+	if maxBytes <= 0 {
+		return io.ReadAll(body)
+	}
+
+	if size > maxBytes {
+		return nil, sourceTooLargeError(size, maxBytes)
+	}
+
+	imageBytes, err := io.ReadAll(io.LimitReader(body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+
+	// The source sent more than it claimed, or didn't say how much it would send.
+	if int64(len(imageBytes)) > maxBytes {
+		return nil, NewStatusError(502, fmt.Sprintf("Source image exceeds the maximum size of %d bytes", maxBytes))
+	}
+
+	return imageBytes, nil
+}
+
+func sourceTooLargeError(size int64, maxBytes int64) *StatusError {
+	return NewStatusError(413, fmt.Sprintf("Source image is %d bytes, the maximum size is %d bytes", size, maxBytes))
+}
+
+// CheckInputDimensions rejects images that are too large to safely decode.
+//
+// Images are loaded lazily by libvips, so this should be called with the dimensions from the
+// image header, before any pixels are decoded. A limit of zero disables that check.
+func CheckInputDimensions(limits InputLimits, width int, height int) error {
+	if limits.MaxWidth > 0 && width > limits.MaxWidth {
+		return NewStatusError(413, fmt.Sprintf("Image width %d exceeds the maximum of %d", width, limits.MaxWidth))
+	}
+
+	if limits.MaxHeight > 0 && height > limits.MaxHeight {
+		return NewStatusError(413, fmt.Sprintf("Image height %d exceeds the maximum of %d", height, limits.MaxHeight))
+	}
+
+	megapixels := float64(width) * float64(height) / 1_000_000
+	if limits.MaxMegapixels > 0 && megapixels > limits.MaxMegapixels {
+		return NewStatusError(413, fmt.Sprintf("Image size %.1f megapixels exceeds the maximum of %.1f megapixels", megapixels, limits.MaxMegapixels))
+	}
+
+	return nil
+}
+
 func NewJpegExportParams(options JpegCompression, stripMetadata bool) *vips.JpegExportParams {
 	jpegParams := &vips.JpegExportParams{
 		StripMetadata:      stripMetadata,
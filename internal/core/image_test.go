@@ -0,0 +1,274 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/beetlebugorg/go-dims/internal/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testSourceBackend struct {
+	body []byte
+}
+
+func (b testSourceBackend) Name() string { return "test" }
+
+func (b testSourceBackend) CanHandle(imageSource string) bool {
+	return strings.HasPrefix(imageSource, "test://")
+}
+
+func (b testSourceBackend) FetchImage(ctx context.Context, imageSource string) (*Image, error) {
+	data, err := ReadImage(ctx, bytes.NewReader(b.body), int64(len(b.body)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Image{Bytes: data, Size: len(data), Status: 200}, nil
+}
+
+func TestFetcherConfig(t *testing.T) {
+	ctx := context.Background()
+	RegisterImageBackend(testSourceBackend{body: make([]byte, 100)})
+
+	allowed := NewFetcher(Config{Source: Source{Default: "http", Allowed: []string{"test"}}}, nil)
+	image, err := allowed.FetchImage(ctx, "test://image.png", time.Second)
+	require.NoError(t, err)
+	assert.Len(t, image.Bytes, 100)
+
+	// Fetchers only use the backends allowed by their own configuration.
+	notAllowed := NewFetcher(Config{Source: Source{Default: "http", Allowed: []string{"http"}}}, nil)
+	_, err = notAllowed.FetchImage(ctx, "test://image.png", time.Second)
+	var statusError *StatusError
+	require.True(t, errors.As(err, &statusError), "expected a StatusError, got %v", err)
+	assert.Equal(t, 400, statusError.StatusCode)
+
+	limited := NewFetcher(Config{Source: Source{Default: "http", Allowed: []string{"test"}, MaxBytes: 10}}, nil)
+	_, err = limited.FetchImage(ctx, "test://image.png", time.Second)
+	require.True(t, errors.As(err, &statusError), "expected a StatusError, got %v", err)
+	assert.Equal(t, 413, statusError.StatusCode)
+}
+
+// blockingSourceBackend waits until its fetch is canceled, reporting why on canceled.
+type blockingSourceBackend struct {
+	canceled chan error
+}
+
+func (b blockingSourceBackend) Name() string { return "blocking" }
+
+func (b blockingSourceBackend) CanHandle(imageSource string) bool {
+	return strings.HasPrefix(imageSource, "blocking://")
+}
+
+func (b blockingSourceBackend) FetchImage(ctx context.Context, imageSource string) (*Image, error) {
+	<-ctx.Done()
+	b.canceled <- ctx.Err()
+
+	return nil, ctx.Err()
+}
+
+func TestFetcherCanceled(t *testing.T) {
+	backend := blockingSourceBackend{canceled: make(chan error, 1)}
+	RegisterImageBackend(backend)
+	fetcher := NewFetcher(Config{Source: Source{Default: "http", Allowed: []string{"blocking"}}}, nil)
+
+	// The client going away cancels the fetch, long before its timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	_, err := fetcher.FetchImage(ctx, "blocking://image.png", time.Minute)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	select {
+	case err := <-backend.canceled:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("the fetch wasn't canceled")
+	}
+}
+
+// endlessReader is a source that never stops sending, counting the bytes read from it.
+type endlessReader struct {
+	read int64
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	r.read += int64(len(p))
+	return len(p), nil
+}
+
+func TestReadImage(t *testing.T) {
+	ctx := context.WithValue(context.Background(), maxBytesKey{}, int64(1000))
+	var statusError *StatusError
+
+	// Sources that report a size over the limit aren't read at all.
+	body := &endlessReader{}
+	_, err := ReadImage(ctx, body, 2000)
+	require.True(t, errors.As(err, &statusError), "expected a StatusError, got %v", err)
+	assert.Equal(t, 413, statusError.StatusCode)
+	assert.Zero(t, body.read)
+
+	// Sources that don't report their size are read until they exceed the limit.
+	body = &endlessReader{}
+	_, err = ReadImage(ctx, body, -1)
+	require.True(t, errors.As(err, &statusError), "expected a StatusError, got %v", err)
+	assert.Equal(t, 502, statusError.StatusCode)
+	assert.LessOrEqual(t, body.read, int64(1001))
+
+	data, err := ReadImage(ctx, bytes.NewReader(make([]byte, 1000)), -1)
+	require.NoError(t, err)
+	assert.Len(t, data, 1000)
+}
+
+func TestCheckInputDimensions(t *testing.T) {
+	limits := InputLimits{MaxWidth: 2000, MaxHeight: 1000, MaxMegapixels: 1}
+
+	tests := []struct {
+		name          string
+		limits        InputLimits
+		width, height int
+		success       bool
+	}{
+		{"within limits", limits, 1000, 1000, true},
+		{"width over limit", limits, 2001, 10, false},
+		{"height over limit", limits, 10, 1001, false},
+		{"megapixels over limit", limits, 1001, 1000, false},
+		{"no limits", InputLimits{}, 100000, 100000, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := CheckInputDimensions(test.limits, test.width, test.height)
+			if !test.success {
+				var statusError *StatusError
+				require.True(t, errors.As(err, &statusError), "expected a StatusError, got %v", err)
+				assert.Equal(t, 413, statusError.StatusCode)
+				return
+			}
+
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// countingSourceBackend serves an image, counting how many times it was fetched.
+type countingSourceBackend struct {
+	fetches *atomic.Int32
+}
+
+func (b countingSourceBackend) Name() string { return "counting" }
+
+func (b countingSourceBackend) CanHandle(imageSource string) bool {
+	return strings.HasPrefix(imageSource, "counting://")
+}
+
+func (b countingSourceBackend) FetchImage(ctx context.Context, imageSource string) (*Image, error) {
+	b.fetches.Add(1)
+
+	return &Image{Bytes: []byte("image"), Size: 5, Status: 200, Etag: `"v1"`}, nil
+}
+
+func TestFetcherSourceCache(t *testing.T) {
+	ctx := context.Background()
+	backend := countingSourceBackend{fetches: &atomic.Int32{}}
+	RegisterImageBackend(backend)
+
+	config := Config{
+		Source:      Source{Default: "http", Allowed: []string{"counting"}},
+		SourceCache: SourceCache{TTL: 60},
+	}
+	cached := NewFetcher(config, cache.NewMemory(1<<20))
+	uncached := NewFetcher(config, nil)
+
+	for _, fetcher := range []*Fetcher{cached, cached, uncached} {
+		image, err := fetcher.FetchImage(ctx, "counting://image.png", time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("image"), image.Bytes)
+	}
+
+	// Each fetcher has its own source cache.
+	assert.Equal(t, int32(2), backend.fetches.Load())
+}
+
+// revalidatingSourceBackend serves an image whose version can change, answering conditional
+// requests for the current version without the image.
+type revalidatingSourceBackend struct {
+	etag    *atomic.Value
+	fetches *atomic.Int32
+}
+
+func (b revalidatingSourceBackend) Name() string { return "revalidating" }
+
+func (b revalidatingSourceBackend) CanHandle(imageSource string) bool {
+	return strings.HasPrefix(imageSource, "revalidating://")
+}
+
+func (b revalidatingSourceBackend) FetchImage(ctx context.Context, imageSource string) (*Image, error) {
+	b.fetches.Add(1)
+	etag := b.etag.Load().(string)
+
+	return &Image{Bytes: []byte("image " + etag), Size: len(etag) + 6, Status: 200, Etag: etag}, nil
+}
+
+func (b revalidatingSourceBackend) RevalidateImage(ctx context.Context, imageSource string, cached *Image) (*Image, error) {
+	if cached.Etag == b.etag.Load().(string) {
+		return cached.Revalidate("", ""), nil
+	}
+
+	return b.FetchImage(ctx, imageSource)
+}
+
+func TestFetcherSourceCacheRevalidate(t *testing.T) {
+	ctx := context.Background()
+	backend := revalidatingSourceBackend{etag: &atomic.Value{}, fetches: &atomic.Int32{}}
+	backend.etag.Store(`"v1"`)
+	RegisterImageBackend(backend)
+
+	sourceCache := cache.NewMemory(1 << 20)
+	fetcher := NewFetcher(Config{
+		Source:      Source{Default: "http", Allowed: []string{"revalidating"}},
+		SourceCache: SourceCache{TTL: 60, MaxStale: 3600},
+	}, sourceCache)
+
+	// Cache v1, then make it stale.
+	imageSource := "revalidating://image.png"
+	image, err := fetcher.FetchImage(ctx, imageSource, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, `"v1"`, image.Etag)
+
+	stale := func() {
+		entry, ok := sourceCache.Get(ctx, sourceKey(imageSource))
+		require.True(t, ok)
+		entry.Created = entry.Created.Add(-time.Hour)
+		sourceCache.Set(ctx, sourceKey(imageSource), entry)
+	}
+	stale()
+
+	// The origin still has v1, so the cached image is used.
+	image, err = fetcher.FetchImage(ctx, imageSource, time.Second)
+	require.NoError(t, err)
+	assert.True(t, image.Revalidated)
+	assert.Equal(t, []byte(`image "v1"`), image.Bytes)
+	assert.Equal(t, int32(1), backend.fetches.Load())
+
+	// The origin has v2, so it replaces the cached image.
+	backend.etag.Store(`"v2"`)
+	stale()
+
+	image, err = fetcher.FetchImage(ctx, imageSource, time.Second)
+	require.NoError(t, err)
+	assert.False(t, image.Revalidated)
+	assert.Equal(t, `"v2"`, image.Etag)
+	assert.Equal(t, []byte(`image "v2"`), image.Bytes)
+
+	image, err = fetcher.FetchImage(ctx, imageSource, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, []byte(`image "v2"`), image.Bytes)
+	assert.Equal(t, int32(2), backend.fetches.Load())
+}
@@ -0,0 +1,98 @@
+package dims
+
+import (
+	"context"
+	"errors"
+	"math"
+
+	"github.com/beetlebugorg/go-dims/internal/admission"
+	"github.com/beetlebugorg/go-dims/internal/core"
+	"github.com/davidbyttow/govips/v2/vips"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// admissionCollectors exports the stats of the admission limiter as Prometheus metrics.
+func (s *Service) admissionCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		s.admissionGauge("admission_capacity", "Processing capacity, in megapixels.",
+			func(stats admission.Stats) float64 { return float64(stats.Capacity) }),
+		s.admissionGauge("admission_used", "Processing capacity in use, in megapixels.",
+			func(stats admission.Stats) float64 { return float64(stats.Used) }),
+		s.admissionGauge("admission_in_flight", "Requests holding processing capacity.",
+			func(stats admission.Stats) float64 { return float64(stats.InFlight) }),
+		s.admissionGauge("admission_queue_depth", "Requests waiting for processing capacity.",
+			func(stats admission.Stats) float64 { return float64(stats.QueueDepth) }),
+		s.admissionCounter("admission_rejected_total", "Requests rejected because processing capacity was saturated.",
+			func(stats admission.Stats) float64 { return float64(stats.Rejected) }),
+		s.admissionCounter("admission_wait_seconds_total", "Total time requests spent waiting for processing capacity.",
+			func(stats admission.Stats) float64 { return stats.WaitTotal.Seconds() }),
+	}
+}
+
+func (s *Service) admissionGauge(name string, help string, value func(admission.Stats) float64) prometheus.Collector {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Namespace: "dims", Name: name, Help: help},
+		func() float64 { return value(s.limiter.Stats()) })
+}
+
+func (s *Service) admissionCounter(name string, help string, value func(admission.Stats) float64) prometheus.Collector {
+	return prometheus.NewCounterFunc(prometheus.CounterOpts{Namespace: "dims", Name: name, Help: help},
+		func() float64 { return value(s.limiter.Stats()) })
+}
+
+// admit waits for weight megapixels of processing capacity, returning a function that gives
+// it back. Requests that can't be admitted fail with a 503.
+func (s *Service) admit(ctx context.Context, weight int64) (func(), error) {
+	release, err := s.acquire(ctx, weight)
+	if errors.Is(err, admission.ErrSaturated) {
+		return nil, &core.StatusError{
+			StatusCode: 503,
+			Message:    "Too many requests, try again later",
+			RetryAfter: s.config.Admission.RetryAfter,
+		}
+	}
+
+	return release, err
+}
+
+// acquire waits for weight megapixels of processing capacity, like the limiter. The work it
+// admits is tracked until it gives the capacity back, so Wait can tell when libvips is idle.
+func (s *Service) acquire(ctx context.Context, weight int64) (func(), error) {
+	release, err := s.limiter.Acquire(ctx, weight)
+	if err != nil {
+		return nil, err
+	}
+
+	s.working.Add(1)
+	return func() {
+		release()
+		s.working.Done()
+	}, nil
+}
+
+// Wait waits until the admitted work is done, including renders abandoned after a timeout, or
+// until ctx is done. libvips must not be shut down before then.
+func (s *Service) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.working.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// estimateCost estimates the cost of processing the image, in megapixels, from its header.
+func estimateCost(image *core.Image) int64 {
+	header, err := vips.NewImageFromBuffer(image.Bytes)
+	if err != nil {
+		return 1
+	}
+	defer header.Close()
+
+	return int64(math.Ceil(float64(header.Width()) * float64(header.Height()) / 1_000_000))
+}
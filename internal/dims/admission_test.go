@@ -0,0 +1,70 @@
+package dims
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/beetlebugorg/go-dims/internal/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceAdmission(t *testing.T) {
+	ctx := context.Background()
+
+	small := NewService(core.Config{Admission: core.Admission{Capacity: 1, MaxQueue: 0, RetryAfter: 7}})
+	large := NewService(core.Config{Admission: core.Admission{Capacity: 10, MaxQueue: 0}})
+
+	release, err := small.admit(ctx, 1)
+	require.NoError(t, err)
+
+	_, err = small.admit(ctx, 1)
+	var statusError *core.StatusError
+	require.True(t, errors.As(err, &statusError), "expected a StatusError, got %v", err)
+	assert.Equal(t, 503, statusError.StatusCode)
+	assert.Equal(t, 7, statusError.RetryAfter)
+
+	// Each service has its own capacity.
+	releaseLarge, err := large.admit(ctx, 5)
+	require.NoError(t, err)
+	releaseLarge()
+
+	release()
+	release, err = small.admit(ctx, 1)
+	require.NoError(t, err)
+	release()
+}
+
+func TestReadinessAdmission(t *testing.T) {
+	service := NewService(core.Config{Admission: core.Admission{Capacity: 1, MaxQueue: 0}})
+
+	release, err := service.admit(context.Background(), 1)
+	require.NoError(t, err)
+
+	// The pipeline check doesn't add to the load of a saturated service.
+	recorder := httptest.NewRecorder()
+	service.HandleReadiness(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, 200, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"pipeline":{"status":"skipped"}`)
+
+	release()
+	assert.Zero(t, service.limiter.Stats().Used)
+}
+
+func TestServiceWait(t *testing.T) {
+	service := NewService(core.Config{Admission: core.Admission{Capacity: 10, MaxQueue: 0}})
+
+	release, err := service.admit(context.Background(), 1)
+	require.NoError(t, err)
+
+	// Admitted work, like a render abandoned after a timeout, keeps the service from being idle.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, service.Wait(ctx), context.DeadlineExceeded)
+
+	release()
+	assert.NoError(t, service.Wait(context.Background()))
+}
@@ -0,0 +1,263 @@
+package dims
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/beetlebugorg/go-dims/internal/cache"
+	"github.com/beetlebugorg/go-dims/internal/core"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// setupCaches builds the render cache tiers, and the source cache, from the configuration.
+// Tiers that fail to start are logged and left out.
+func (s *Service) setupCaches() {
+	var tiers []cache.Cache
+	var sourceTiers []cache.Cache
+
+	if s.config.SourceCache.MaxBytes > 0 {
+		sourceMemoryCache := cache.NewMemory(s.config.SourceCache.MaxBytes)
+		sourceTiers = append(sourceTiers, sourceMemoryCache)
+		s.caches = append(s.caches, namedCache{"source", sourceMemoryCache})
+
+		s.publish("source_cache", func() any { return sourceMemoryCache.Stats() })
+		s.registry.MustRegister(cacheCollectors("source_cache", "source images", sourceMemoryCache.Stats)...)
+	}
+
+	if s.config.RenderCache.MaxBytes > 0 {
+		memoryCache := cache.NewMemory(s.config.RenderCache.MaxBytes)
+		tiers = append(tiers, memoryCache)
+		s.caches = append(s.caches, namedCache{"render", memoryCache})
+
+		s.publish("render_cache", func() any { return memoryCache.Stats() })
+		s.registry.MustRegister(cacheCollectors("render_cache", "rendered images", memoryCache.Stats)...)
+	}
+
+	if s.config.DiskCache.Dir != "" && s.config.DiskCache.MaxBytes > 0 {
+		diskCache, err := cache.NewDisk(s.config.DiskCache.Dir, s.config.DiskCache.MaxBytes)
+		if err != nil {
+			slog.Error("disk cache disabled", "dir", s.config.DiskCache.Dir, "error", err)
+		} else {
+			tiers = append(tiers, diskCache)
+			sourceTiers = append(sourceTiers, diskCache)
+			s.caches = append(s.caches, namedCache{"disk", diskCache})
+
+			s.publish("disk_cache", func() any { return diskCache.Stats() })
+			s.registry.MustRegister(cacheCollectors("disk_cache", "source and rendered images", diskCache.Stats)...)
+		}
+	}
+
+	// Redis is shared by every instance, and only holds renders.
+	if s.config.RedisCache.URL != "" {
+		client, err := newRedisClient(s.config.RedisCache)
+		if err != nil {
+			slog.Error("redis cache disabled", "error", err)
+		} else {
+			redisCache := cache.NewRedis(client, s.config.RedisCache.Prefix, s.config.RedisCache.MaxObjectBytes)
+			tiers = append(tiers, redisCache)
+			s.caches = append(s.caches, namedCache{"redis", redisCache})
+
+			s.publish("redis_cache", func() any { return redisCache.Stats() })
+			s.registry.MustRegister(append(cacheCounters("redis_cache", redisCache.Stats),
+				counter("redis_cache", "errors_total", "Reads and writes to Redis that failed.",
+					func() float64 { return float64(redisCache.Stats().Errors) }))...)
+		}
+	}
+
+	// The bucket is shared by every instance, so it is checked last and only holds renders.
+	if s.config.BucketCache.Bucket != "" {
+		client, err := newBucketClient(s.config.BucketCache)
+		if err != nil {
+			slog.Error("bucket cache disabled", "bucket", s.config.BucketCache.Bucket, "error", err)
+		} else {
+			bucketCache := cache.NewBucket(client, s.config.BucketCache.Bucket, s.config.BucketCache.Prefix,
+				time.Duration(s.config.BucketCache.Timeout)*time.Millisecond)
+			tiers = append(tiers, bucketCache)
+			s.caches = append(s.caches, namedCache{"bucket", bucketCache})
+
+			s.publish("bucket_cache", func() any { return bucketCache.Stats() })
+			s.registry.MustRegister(append(cacheCounters("bucket_cache", bucketCache.Stats),
+				counter("bucket_cache", "errors_total", "Reads and writes to the bucket that failed.",
+					func() float64 { return float64(bucketCache.Stats().Errors) }))...)
+		}
+	}
+
+	var sourceCache cache.Cache
+	if len(sourceTiers) > 0 {
+		sourceCache = s.newTiers(sourceTiers)
+	}
+	s.fetcher = core.NewFetcher(s.config, sourceCache)
+
+	if len(tiers) > 0 {
+		s.renderCache = s.newTiers(tiers)
+	}
+}
+
+// newTiers returns the caches as tiers, which are told about every purge.
+func (s *Service) newTiers(caches []cache.Cache) *cache.Tiers {
+	tiers := cache.NewTiers(caches...)
+	s.tiers = append(s.tiers, tiers)
+
+	return tiers
+}
+
+// newRedisClient returns a Redis client for the Redis cache. Every command is bounded by the
+// timeout, and isn't retried, so a slow or missing Redis only costs one timeout.
+func newRedisClient(redisConfig core.RedisCache) (*redis.Client, error) {
+	options, err := redis.ParseURL(redisConfig.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := time.Duration(redisConfig.Timeout) * time.Millisecond
+	options.DialTimeout = timeout
+	options.ReadTimeout = timeout
+	options.WriteTimeout = timeout
+	options.MaxRetries = -1
+
+	return redis.NewClient(options), nil
+}
+
+// newBucketClient returns an S3 client for the bucket cache. A custom endpoint and path-style
+// addressing allow S3-compatible stores, like MinIO.
+func newBucketClient(bucketConfig core.BucketCache) (*s3.Client, error) {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return s3.NewFromConfig(cfg, func(options *s3.Options) {
+		if bucketConfig.Region != "" {
+			options.Region = bucketConfig.Region
+		}
+		if bucketConfig.Endpoint != "" {
+			options.BaseEndpoint = aws.String(bucketConfig.Endpoint)
+		}
+		options.UsePathStyle = bucketConfig.PathStyle
+	}), nil
+}
+
+// cacheCollectors exports the stats of a cache as Prometheus metrics named after prefix.
+func cacheCollectors(prefix string, contents string, stats func() cache.Stats) []prometheus.Collector {
+	gauge := func(name string, help string, value func(cache.Stats) float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Namespace: "dims", Name: prefix + "_" + name, Help: help},
+			func() float64 { return value(stats()) })
+	}
+
+	return append([]prometheus.Collector{
+		gauge("bytes", "Size of the "+contents+" in the cache.",
+			func(s cache.Stats) float64 { return float64(s.Bytes) }),
+		gauge("entries", "Number of "+contents+" in the cache.",
+			func(s cache.Stats) float64 { return float64(s.Entries) }),
+		counter(prefix, "evictions_total", "Entries evicted to make room in the cache.",
+			func() float64 { return float64(stats().Evictions) }),
+	}, cacheCounters(prefix, stats)...)
+}
+
+// cacheCounters exports the lookups made in a cache, for caches that don't track their size.
+func cacheCounters(prefix string, stats func() cache.Stats) []prometheus.Collector {
+	return []prometheus.Collector{
+		counter(prefix, "hits_total", "Lookups served from the cache.",
+			func() float64 { return float64(stats().Hits) }),
+		counter(prefix, "misses_total", "Lookups not found in the cache.",
+			func() float64 { return float64(stats().Misses) }),
+	}
+}
+
+func counter(prefix string, name string, help string, value func() float64) prometheus.Collector {
+	return prometheus.NewCounterFunc(prometheus.CounterOpts{Namespace: "dims", Name: prefix + "_" + name, Help: help}, value)
+}
+
+// outputConfig is the configuration that changes the rendered image or its headers.
+type outputConfig struct {
+	EtagAlgorithm      string
+	OutputFormat       core.OutputFormat
+	Options            core.Options
+	ImageOutputOptions core.ImageOutputOptions
+	OutputLimits       core.OutputLimits
+	OriginCacheControl core.OriginCacheControl
+	CacheControl       core.CacheControlDirectives
+	EdgeControl        core.EdgeControl
+	SurrogateKeys      core.SurrogateKeys
+}
+
+// renderKey identifies the rendered image for a request. Along with the request's HashId it
+// covers the configuration and query parameters that change the output, so a configuration
+// change never serves a stale variant.
+func renderKey(request RequestContext) string {
+	config := request.Config()
+
+	fingerprint, _ := json.Marshal(outputConfig{
+		EtagAlgorithm:      config.EtagAlgorithm,
+		OutputFormat:       config.OutputFormat,
+		Options:            config.Options,
+		ImageOutputOptions: config.ImageOutputOptions,
+		OutputLimits:       config.OutputLimits,
+		OriginCacheControl: config.OriginCacheControl,
+		CacheControl:       config.CacheControlDirectives,
+		EdgeControl:        config.EdgeControl,
+		SurrogateKeys:      config.SurrogateKeys,
+	})
+
+	h := sha256.New()
+	h.Write([]byte(request.HashId()))
+	h.Write([]byte{0})
+	h.Write(fingerprint)
+	h.Write([]byte{0})
+	h.Write([]byte(request.ContentDisposition()))
+	h.Write([]byte{0})
+
+	// The tag in the surrogate keys comes from a query parameter that isn't part of the HashId.
+	_, surrogateKeys := request.SurrogateKey()
+	h.Write([]byte(surrogateKeys))
+
+	// The output format is part of the key, so each format can be handled separately, i.e. by
+	// lifecycle rules in the bucket cache.
+	format := request.OutputFormat()
+	if format == "" {
+		format = "auto"
+	}
+
+	return "render:" + format + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// cachedImage returns the rendered image for the request from the render cache, if any.
+func (s *Service) cachedImage(ctx context.Context, key string) (*cache.Entry, bool) {
+	if s.renderCache == nil {
+		return nil, false
+	}
+
+	return s.renderCache.Get(ctx, key)
+}
+
+// renderedImage returns the rendered image along with the headers sent with it, expiring when
+// the response's max-age runs out.
+func renderedImage(job renderJob, imageType string, imageBlob []byte) *cache.Entry {
+	now := time.Now()
+
+	return &cache.Entry{
+		Format:  imageType,
+		Body:    imageBlob,
+		Headers: job.headers,
+		Source:  job.source,
+		Created: now,
+		Expires: now.Add(time.Duration(job.maxAge) * time.Second),
+	}
+}
+
+// cacheImage stores the rendered image, for as long as the response's max-age allows.
+func (s *Service) cacheImage(ctx context.Context, job renderJob, rendered *cache.Entry) {
+	if s.renderCache == nil || job.maxAge <= 0 {
+		return
+	}
+
+	s.renderCache.Set(ctx, job.key, rendered)
+}
@@ -0,0 +1,151 @@
+package dims
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/beetlebugorg/go-dims/internal/cache"
+	"github.com/beetlebugorg/go-dims/internal/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceCaches(t *testing.T) {
+	ctx := context.Background()
+	key := "render:png:abc"
+	source := "http://example.com/image.jpg"
+
+	first := NewService(core.Config{
+		RenderCache: core.RenderCache{MaxBytes: 1 << 20},
+		DiskCache:   core.DiskCache{Dir: t.TempDir(), MaxBytes: 1 << 20},
+	})
+	second := NewService(core.Config{RenderCache: core.RenderCache{MaxBytes: 1 << 20}})
+
+	now := time.Now()
+	first.renderCache.Set(ctx, key, &cache.Entry{
+		Format:  "png",
+		Body:    []byte("image"),
+		Source:  source,
+		Created: now,
+		Expires: now.Add(time.Minute),
+	})
+
+	_, ok := first.cachedImage(ctx, key)
+	assert.True(t, ok)
+
+	_, ok = second.cachedImage(ctx, key)
+	assert.False(t, ok, "services don't share their caches")
+
+	counts, err := first.Purge(ctx, source)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"render": 1, "disk": 1}, counts)
+
+	_, ok = first.cachedImage(ctx, key)
+	assert.False(t, ok)
+}
+
+func TestServiceWithoutCaches(t *testing.T) {
+	service := NewService(core.Config{})
+
+	assert.Nil(t, service.renderCache)
+	counts, err := service.Purge(context.Background(), "http://example.com/image.jpg")
+	assert.NoError(t, err)
+	assert.Empty(t, counts)
+}
+
+// backTier is a slow cache behind the others, which may fail to purge.
+type backTier struct {
+	*cache.Memory
+	err error
+}
+
+func (b *backTier) PurgeSource(ctx context.Context, source string) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	return b.Memory.PurgeSource(ctx, source)
+}
+
+func TestServicePurgeBackTier(t *testing.T) {
+	ctx := context.Background()
+	key := "render:png:abc"
+	source := "http://example.com/image.jpg"
+
+	service := NewService(core.Config{RenderCache: core.RenderCache{MaxBytes: 1 << 20}})
+	back := &backTier{Memory: cache.NewMemory(1 << 20)}
+	service.caches = append(service.caches, namedCache{"back", back})
+	service.renderCache = service.newTiers([]cache.Cache{service.caches[0].cache, back})
+
+	now := time.Now()
+	set := func() {
+		back.Set(ctx, key, &cache.Entry{
+			Format:  "png",
+			Body:    []byte("image"),
+			Source:  source,
+			Created: now,
+			Expires: now.Add(time.Minute),
+		})
+
+		// Copied into the render cache by the lookup.
+		_, ok := service.cachedImage(ctx, key)
+		require.True(t, ok)
+	}
+
+	// A back tier that fails to purge fails the purge.
+	set()
+	back.err = errors.New("unreachable")
+	recorder := httptest.NewRecorder()
+	service.HandlePurge(recorder, httptest.NewRequest("POST", "/purge?url="+source, nil))
+	assert.Equal(t, 500, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "back cache: unreachable")
+
+	// The image is purged from every tier, so it isn't copied back into the render cache.
+	back.err = nil
+	now = now.Add(time.Second)
+	set()
+	counts, err := service.Purge(ctx, source)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"render": 1, "back": 1}, counts)
+
+	_, ok := service.cachedImage(ctx, key)
+	assert.False(t, ok)
+}
+
+func TestServicePurgeUnpurgeableTier(t *testing.T) {
+	service := NewService(core.Config{})
+	service.caches = append(service.caches, namedCache{"readonly", cache.NewTiers()})
+
+	_, err := service.Purge(context.Background(), "http://example.com/image.jpg")
+	assert.ErrorContains(t, err, "readonly cache can't be purged")
+}
+
+func TestServicePurgeRedis(t *testing.T) {
+	ctx := context.Background()
+	key := "render:png:abc"
+	source := "http://example.com/image.jpg"
+	server := miniredis.RunT(t)
+
+	config := core.Config{RenderCache: core.RenderCache{MaxBytes: 1 << 20}}
+	config.RedisCache = core.RedisCache{URL: "redis://" + server.Addr(), Prefix: "dims:", MaxObjectBytes: 1 << 20, Timeout: 1000}
+	service := NewService(config)
+
+	now := time.Now()
+	service.renderCache.Set(ctx, key, &cache.Entry{
+		Format:  "png",
+		Body:    []byte("image"),
+		Source:  source,
+		Created: now,
+		Expires: now.Add(time.Minute),
+	})
+	require.True(t, server.Exists("dims:"+key))
+
+	counts, err := service.Purge(ctx, source)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"render": 1, "redis": 1}, counts)
+	assert.False(t, server.Exists("dims:"+key))
+}
@@ -0,0 +1,60 @@
+package dims
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/beetlebugorg/go-dims/internal/cachecontrol"
+	"github.com/beetlebugorg/go-dims/internal/core"
+)
+
+// SuccessCacheControl returns the Cache-Control header for an image that shared caches may keep
+// for maxAge seconds, with the directives configured for successful responses.
+func SuccessCacheControl(config core.Config, maxAge int) cachecontrol.Header {
+	directives := config.CacheControlDirectives
+
+	header := cachecontrol.Header{
+		MaxAge:               maxAge,
+		StaleWhileRevalidate: orDefault(directives.SuccessStaleWhileRevalidate, directives.StaleWhileRevalidate),
+		StaleIfError:         orDefault(directives.SuccessStaleIfError, directives.StaleIfError),
+		Immutable:            directives.Immutable,
+	}
+
+	if directives.BrowserMaxAge >= 0 {
+		header.MaxAge = directives.BrowserMaxAge
+		header.SharedMaxAge = maxAge
+	}
+
+	return header
+}
+
+// ErrorHeaders returns the caching headers for error images, which are cached for
+// DIMS_CACHE_CONTROL_ERROR seconds with the directives configured for error responses.
+func ErrorHeaders(config core.Config) map[string]string {
+	headers := make(map[string]string)
+
+	maxAge := config.OriginCacheControl.Error
+	if maxAge <= 0 {
+		return headers
+	}
+
+	directives := config.CacheControlDirectives
+	headers["Cache-Control"] = cachecontrol.Header{
+		MaxAge:               maxAge,
+		StaleWhileRevalidate: orDefault(directives.ErrorStaleWhileRevalidate, directives.StaleWhileRevalidate),
+		StaleIfError:         orDefault(directives.ErrorStaleIfError, directives.StaleIfError),
+		Immutable:            directives.ErrorImmutable,
+	}.String()
+	headers["Expires"] = time.Now().Add(time.Duration(maxAge) * time.Second).UTC().Format(http.TimeFormat)
+
+	return headers
+}
+
+// orDefault returns value, or the global setting when value is -1.
+func orDefault(value int, global int) int {
+	if value < 0 {
+		return global
+	}
+
+	return value
+}
@@ -0,0 +1,74 @@
+package dims
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Conditional is implemented by requests that carry the client's conditional headers.
+type Conditional interface {
+	IfNoneMatch() string
+	IfModifiedSince() string
+}
+
+// notModified reports whether the client already has the image with the given ETag and
+// Last-Modified headers, following RFC 9110: If-None-Match is used when present, otherwise
+// If-Modified-Since.
+func notModified(conditional Conditional, etag string, lastModified string) bool {
+	if ifNoneMatch := conditional.IfNoneMatch(); ifNoneMatch != "" {
+		return etag != "" && etagMatches(ifNoneMatch, etag)
+	}
+
+	ifModifiedSince := conditional.IfModifiedSince()
+	if ifModifiedSince == "" || lastModified == "" {
+		return false
+	}
+
+	since, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+
+	return !modified.After(since)
+}
+
+// etagMatches compares an If-None-Match list against etag, using the weak comparison.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+
+	etag = opaqueTag(etag)
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if opaqueTag(candidate) == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// opaqueTag strips the weak prefix and quotes from an entity tag.
+func opaqueTag(tag string) string {
+	tag = strings.TrimSpace(tag)
+	tag = strings.TrimPrefix(tag, "W/")
+
+	return strings.Trim(tag, `"`)
+}
+
+// notModifiedHeaders returns the headers sent with a 304, the image's caching headers.
+func notModifiedHeaders(headers map[string]string) map[string]string {
+	notModified := make(map[string]string, len(headers))
+	for key, value := range headers {
+		if key != "Content-Disposition" {
+			notModified[key] = value
+		}
+	}
+
+	return notModified
+}
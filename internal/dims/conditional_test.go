@@ -0,0 +1,77 @@
+package dims
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type conditional struct {
+	ifNoneMatch     string
+	ifModifiedSince string
+}
+
+func (c conditional) IfNoneMatch() string     { return c.ifNoneMatch }
+func (c conditional) IfModifiedSince() string { return c.ifModifiedSince }
+
+func TestNotModified(t *testing.T) {
+	lastModified := "Wed, 21 Oct 2015 07:28:00 GMT"
+
+	tests := []struct {
+		name         string
+		conditional  conditional
+		etag         string
+		lastModified string
+		want         bool
+	}{
+		{"no conditional headers", conditional{}, "abc", lastModified, false},
+		{"strong match", conditional{ifNoneMatch: `"abc"`}, "abc", "", true},
+		{"unquoted match", conditional{ifNoneMatch: "abc"}, "abc", "", true},
+		{"mismatch", conditional{ifNoneMatch: `"xyz"`}, "abc", "", false},
+		{"weak client tag", conditional{ifNoneMatch: `W/"abc"`}, "abc", "", true},
+		{"weak image tag", conditional{ifNoneMatch: `"abc"`}, `W/"abc"`, "", true},
+		{"list match", conditional{ifNoneMatch: `"xyz", W/"abc"`}, "abc", "", true},
+		{"list mismatch", conditional{ifNoneMatch: `"xyz", "uvw"`}, "abc", "", false},
+		{"any", conditional{ifNoneMatch: "*"}, "abc", "", true},
+		{"any padded", conditional{ifNoneMatch: " * "}, "abc", "", true},
+		{"no image etag", conditional{ifNoneMatch: `"abc"`}, "", lastModified, false},
+		{"not modified since", conditional{ifModifiedSince: lastModified}, "", lastModified, true},
+		{"not modified since later", conditional{ifModifiedSince: "Thu, 22 Oct 2015 07:28:00 GMT"}, "", lastModified, true},
+		{"modified since", conditional{ifModifiedSince: "Tue, 20 Oct 2015 07:28:00 GMT"}, "", lastModified, false},
+		{"invalid since", conditional{ifModifiedSince: "yesterday"}, "", lastModified, false},
+		{"no last modified", conditional{ifModifiedSince: lastModified}, "", "", false},
+		{
+			"if-none-match takes precedence",
+			conditional{ifNoneMatch: `"xyz"`, ifModifiedSince: lastModified},
+			"abc", lastModified, false,
+		},
+		{
+			"if-none-match takes precedence without etag",
+			conditional{ifNoneMatch: `"abc"`, ifModifiedSince: lastModified},
+			"", lastModified, false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, notModified(tt.conditional, tt.etag, tt.lastModified))
+		})
+	}
+}
+
+func TestNotModifiedHeaders(t *testing.T) {
+	headers := map[string]string{
+		"Cache-Control":       "max-age=60, public",
+		"ETag":                "abc",
+		"Last-Modified":       "Wed, 21 Oct 2015 07:28:00 GMT",
+		"Content-Disposition": `attachment; filename="image.jpg"`,
+	}
+
+	assert.Equal(t, map[string]string{
+		"Cache-Control": "max-age=60, public",
+		"ETag":          "abc",
+		"Last-Modified": "Wed, 21 Oct 2015 07:28:00 GMT",
+	}, notModifiedHeaders(headers))
+
+	assert.Contains(t, headers, "Content-Disposition", "the image's headers must not be modified")
+}
@@ -0,0 +1,143 @@
+package dims
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// Timings records how long each stage of a request took, for the Server-Timing header.
+//
+// Processing may still be running in the background when a request times out, so it is safe
+// for concurrent use.
+type Timings struct {
+	mu      sync.Mutex
+	entries []timing
+}
+
+type timing struct {
+	name        string
+	description string
+	duration    time.Duration
+}
+
+// Add records that the named stage took duration.
+func (t *Timings) Add(name string, description string, duration time.Duration) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.entries = append(t.entries, timing{name, description, duration})
+}
+
+// Merge adds the timings recorded in other.
+func (t *Timings) Merge(other *Timings) {
+	if t == nil || other == nil {
+		return
+	}
+
+	other.mu.Lock()
+	entries := slices.Clone(other.entries)
+	other.mu.Unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.entries = append(t.entries, entries...)
+}
+
+// String formats the timings as a Server-Timing header value, i.e.
+// `fetch;dur=12.5, resize;desc="100x100";dur=3.1`.
+func (t *Timings) String() string {
+	if t == nil {
+		return ""
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	metrics := make([]string, 0, len(t.entries))
+	for _, entry := range t.entries {
+		metric := entry.name
+		if entry.description != "" {
+			metric += ";desc=" + strconv.Quote(entry.description)
+		}
+		metric += fmt.Sprintf(";dur=%.1f", float64(entry.duration.Microseconds())/1000)
+
+		metrics = append(metrics, metric)
+	}
+
+	return strings.Join(metrics, ", ")
+}
+
+// Timings returns the time taken by each stage of the request so far.
+func (r *Request) Timings() *Timings {
+	return r.timings
+}
+
+// debugEnabled is true when debug headers are turned on for every request, or the request
+// has a signed `debug` parameter.
+func (r *Request) debugEnabled() bool {
+	if r.config.Diagnostics.DebugHeaders {
+		return true
+	}
+
+	debug := r.SignedParams["debug"]
+
+	return debug == "1" || debug == "true"
+}
+
+// DebugHeaders returns the Server-Timing and debug headers for the response, if enabled.
+func (r *Request) DebugHeaders(imageFormat string, imageBlob []byte) map[string]string {
+	headers := make(map[string]string)
+
+	debug := r.debugEnabled()
+	if debug || r.config.Diagnostics.ServerTiming {
+		if serverTiming := r.timings.String(); serverTiming != "" {
+			headers["Server-Timing"] = serverTiming
+		}
+	}
+
+	if !debug {
+		return headers
+	}
+
+	if r.SourceImage.Bytes != nil {
+		headers["X-Dims-Source-Size"] = strconv.Itoa(len(r.SourceImage.Bytes))
+		headers["X-Dims-Source-Format"] = vips.ImageTypes[r.SourceImage.Format]
+	}
+
+	if r.shrinkFactor > 0 {
+		headers["X-Dims-Shrink-Factor"] = strconv.Itoa(r.shrinkFactor)
+	}
+
+	commands := make([]string, 0)
+	for _, command := range r.Commands() {
+		commands = append(commands, command.Name+"/"+command.Args)
+	}
+	headers["X-Dims-Commands"] = headerValue(strings.Join(commands, "/"))
+
+	headers["X-Dims-Output-Format"] = strings.ToLower(imageFormat)
+	headers["X-Dims-Output-Size"] = strconv.Itoa(len(imageBlob))
+
+	return headers
+}
+
+// headerValue drops control characters, which can come from URL-decoded commands.
+func headerValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+
+		return r
+	}, value)
+}
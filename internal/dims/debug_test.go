@@ -0,0 +1,46 @@
+package dims
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beetlebugorg/go-dims/internal/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeSharedRender(t *testing.T) {
+	u, _ := url.Parse("/v5/resize/100x100/?url=http://example.com/image.jpg")
+	config := core.Config{}
+	config.Diagnostics.DebugHeaders = true
+
+	newRequest := func() *Request {
+		request, err := NewRequest(context.Background(), u, "resize/100x100", config)
+		require.NoError(t, err)
+		return request
+	}
+
+	leader, waiter := newRequest(), newRequest()
+	leader.timings.Add("fetch", "", time.Millisecond)
+	waiter.timings.Add("fetch", "", 2*time.Millisecond)
+
+	renderer := leader.Detach()
+	renderer.timings.Add("resize", "100x100", 3*time.Millisecond)
+	renderer.shrinkFactor = 4
+
+	leader.Merge(renderer)
+	waiter.Merge(renderer)
+
+	for _, request := range []*Request{leader, waiter} {
+		headers := request.DebugHeaders("jpeg", []byte("image"))
+		assert.Equal(t, "4", headers["X-Dims-Shrink-Factor"])
+		assert.True(t, strings.HasPrefix(headers["Server-Timing"], "fetch;"), headers["Server-Timing"])
+		assert.Contains(t, headers["Server-Timing"], `resize;desc="100x100";dur=3.0`)
+	}
+
+	assert.Contains(t, leader.timings.String(), "fetch;dur=1.0")
+	assert.Contains(t, waiter.timings.String(), "fetch;dur=2.0", "each request keeps its own fetch timing")
+}
@@ -1,7 +1,14 @@
 package dims
 
 import (
+	"context"
+	"github.com/beetlebugorg/go-dims/internal/accesslog"
+	"github.com/beetlebugorg/go-dims/internal/cache"
 	"github.com/beetlebugorg/go-dims/internal/core"
+	"github.com/beetlebugorg/go-dims/internal/metrics"
+	"github.com/beetlebugorg/go-dims/internal/peers"
+	"github.com/beetlebugorg/go-dims/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"time"
 
 	"github.com/davidbyttow/govips/v2/vips"
@@ -12,49 +19,277 @@ type Headers interface {
 	LastModified() string
 	Expires() string
 	CacheControl() string
+	MaxAge() int
 	EdgeControl() string
+	SurrogateControl() string
+	CDNCacheControl() string
 	ContentDisposition() string
+	SurrogateKey() (string, string)
+	DebugHeaders(imageFormat string, imageBlob []byte) map[string]string
+}
+
+// ResponseHeaders returns the caching and disposition headers sent with a rendered image.
+func ResponseHeaders(h Headers) map[string]string {
+	headers := make(map[string]string)
+
+	if cacheControl := h.CacheControl(); cacheControl != "" {
+		headers["Cache-Control"] = cacheControl
+	}
+
+	if expires := h.Expires(); expires != "" {
+		headers["Expires"] = expires
+	}
+
+	if edgeControl := h.EdgeControl(); edgeControl != "" {
+		headers["Edge-Control"] = edgeControl
+	}
+
+	if surrogateControl := h.SurrogateControl(); surrogateControl != "" {
+		headers["Surrogate-Control"] = surrogateControl
+	}
+
+	if cdnCacheControl := h.CDNCacheControl(); cdnCacheControl != "" {
+		headers["CDN-Cache-Control"] = cdnCacheControl
+	}
+
+	if header, keys := h.SurrogateKey(); header != "" {
+		headers[header] = keys
+	}
+
+	if contentDisposition := h.ContentDisposition(); contentDisposition != "" {
+		headers["Content-Disposition"] = contentDisposition
+	}
+
+	if etag := h.Etag(); etag != "" {
+		headers["ETag"] = etag
+	}
+
+	if lastModified := h.LastModified(); lastModified != "" {
+		headers["Last-Modified"] = lastModified
+	}
+
+	return headers
 }
 
 type RequestContext interface {
 	Headers
+	Conditional
+	HashId() string
+	SourceURL() string
+	OutputFormat() string
+	Context() context.Context
 	Config() core.Config
 	Validate() bool
-	FetchImage(timeout time.Duration) (*core.Image, error)
+	FetchImage(ctx context.Context, fetcher *core.Fetcher, timeout time.Duration) (*core.Image, error)
 	LoadImage(image *core.Image) (*vips.ImageRef, error)
-	ProcessImage(img *vips.ImageRef, strip bool) (string, []byte, error)
+	ProcessImage(ctx context.Context, img *vips.ImageRef, strip bool) (string, []byte, error)
+	Detach() *Request
+	Merge(renderer *Request)
 	SendImage(status int, imageFormat string, imageBlob []byte) error
+	SendCached(entry *cache.Entry) error
+	SendNotModified(headers map[string]string) error
 }
 
-func Handler(request RequestContext) error {
+// Handler serves an image request.
+func (s *Service) Handler(request RequestContext) error {
+	// Everything below is bound to the client request, so work stops once the client is gone.
+	ctx := request.Context()
+
 	// Validate the request.
 	if !request.Config().DevelopmentMode && !request.Validate() {
+		metrics.SignatureFailures.Inc()
 		return core.NewStatusError(403, "Invalid signature")
 	}
 
+	// Serve the rendered image from the cache, skipping everything else.
+	key := renderKey(request)
+	if entry, ok := s.cachedImage(ctx, key); ok {
+		accesslog.SetCache(ctx, "hit")
+
+		return sendCached(request, entry)
+	} else if s.renderCache != nil {
+		accesslog.SetCache(ctx, "miss")
+	}
+
+	// Ask the peer that owns the render key, so each image is only rendered by one replica.
+	if entry, ok, err := peers.Lookup(ctx, key); err != nil {
+		return err
+	} else if ok {
+		accesslog.SetCache(ctx, "peer")
+
+		return sendCached(request, entry)
+	}
+
 	// Download image.
-	timeout := time.Duration(request.Config().Timeout.Download) * time.Millisecond
-	sourceImage, err := request.FetchImage(timeout)
+	release, err := s.admit(ctx, 1)
 	if err != nil {
 		return err
 	}
 
-	// Convert image to vips image.
-	vipsImage, err := request.LoadImage(sourceImage)
+	timeout := time.Duration(request.Config().Timeout.Download) * time.Millisecond
+	sourceImage, err := request.FetchImage(ctx, s.fetcher, timeout)
+	release()
 	if err != nil {
 		return err
 	}
 
-	// Execute Imagemagick commands.
-	imageType, imageBlob, err := request.ProcessImage(vipsImage, false)
+	// The ETag and Last-Modified headers are known once the source image is fetched, so a
+	// client revalidating an image it already has is answered without decoding anything.
+	if notModified(request, request.Etag(), request.LastModified()) {
+		return request.SendNotModified(notModifiedHeaders(ResponseHeaders(request)))
+	}
+
+	// Concurrent requests for the same image share one render. It may outlive this request, so
+	// everything it needs is copied from the request first.
+	job := newRenderJob(request, key, sourceImage)
+	result, shared, err := s.renders.Do(ctx, key, func(ctx context.Context) (renderResult, error) {
+		return s.render(ctx, job)
+	})
 	if err != nil {
 		return err
 	}
 
+	// Every request waiting on the render gets its timings, on top of its own.
+	request.Merge(result.renderer)
+	rendered := result.entry
+
+	if shared {
+		metrics.Coalesced.WithLabelValues("render").Inc()
+		accesslog.SetCache(ctx, "coalesced")
+	}
+
+	accesslog.SetOutputFormat(ctx, rendered.Format)
+
 	// Serve the image.
-	if err := request.SendImage(200, imageType, imageBlob); err != nil {
+	if err := request.SendImage(200, rendered.Format, rendered.Body); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// sendCached sends an image rendered earlier, or a 304 if the client already has it.
+func sendCached(request RequestContext, entry *cache.Entry) error {
+	if notModified(request, entry.Headers["ETag"], entry.Headers["Last-Modified"]) {
+		return request.SendNotModified(notModifiedHeaders(entry.Headers))
+	}
+
+	accesslog.SetOutputFormat(request.Context(), entry.Format)
+
+	return request.SendCached(entry)
+}
+
+// renderJob is what a render needs from the request that started it, copied so that it
+// doesn't share anything with that request.
+type renderJob struct {
+	key         string
+	renderer    *Request // A detached copy of the request, with its own copy of the configuration.
+	sourceImage *core.Image
+	headers     map[string]string // The headers sent with the rendered image.
+	source      string
+	maxAge      int
+}
+
+func newRenderJob(request RequestContext, key string, sourceImage *core.Image) renderJob {
+	return renderJob{
+		key:         key,
+		renderer:    request.Detach(),
+		sourceImage: sourceImage,
+		headers:     ResponseHeaders(request),
+		source:      request.SourceURL(),
+		maxAge:      request.MaxAge(),
+	}
+}
+
+// renderResult is a rendered image, along with the finished renderer it was rendered with.
+type renderResult struct {
+	entry    *cache.Entry
+	renderer *Request
+}
+
+// render processes the source image, and stores the result in the render cache.
+//
+// It runs once for all the requests waiting on the render key, on a context that outlives
+// any one of them, so every step applies its own timeout.
+func (s *Service) render(ctx context.Context, job renderJob) (renderResult, error) {
+	// Load, process, and export the image.
+	release, err := s.admit(ctx, estimateCost(job.sourceImage))
+	if err != nil {
+		return renderResult{}, err
+	}
+
+	// Processing may go on in the background after a timeout. It holds its admission until it
+	// is done.
+	processingTimeout := time.Duration(job.renderer.Config().Timeout.Processing) * time.Millisecond
+	imageType, imageBlob, err := processImage(ctx, job.renderer, job.sourceImage, processingTimeout, release)
+	if err != nil {
+		return renderResult{}, err
+	}
+
+	rendered := renderedImage(job, imageType, imageBlob)
+	s.cacheImage(ctx, job, rendered)
+
+	return renderResult{entry: rendered, renderer: job.renderer}, nil
+}
+
+type processResult struct {
+	imageType string
+	imageBlob []byte
+	err       error
+}
+
+// imageRenderer loads and processes images, i.e. a detached Request.
+type imageRenderer interface {
+	LoadImage(image *core.Image) (*vips.ImageRef, error)
+	ProcessImage(ctx context.Context, img *vips.ImageRef, strip bool) (string, []byte, error)
+}
+
+// processImage loads the source image, executes the commands, and exports the result.
+//
+// If that takes longer than timeout the request fails with a 504. The work is abandoned in the
+// background, stopping before the next command, since libvips operations can't be interrupted.
+// The renderer is left to the abandoned work, so it must not be used by anything else, and
+// release is called once the work is actually done, so abandoned work still counts against
+// admission.
+func processImage(ctx context.Context, renderer imageRenderer, sourceImage *core.Image, timeout time.Duration, release func()) (string, []byte, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	result := make(chan processResult, 1)
+	go func() {
+		defer release()
+
+		// Convert image to vips image.
+		_, span := tracing.Tracer.Start(ctx, "decode")
+		vipsImage, err := renderer.LoadImage(sourceImage)
+		if err == nil {
+			span.SetAttributes(
+				attribute.Int("dims.image.width", vipsImage.Width()),
+				attribute.Int("dims.image.height", vipsImage.Height()),
+			)
+		}
+		tracing.End(span, err)
+		if err != nil {
+			result <- processResult{err: err}
+			return
+		}
+
+		// Execute Imagemagick commands.
+		imageType, imageBlob, err := renderer.ProcessImage(ctx, vipsImage, false)
+		result <- processResult{imageType, imageBlob, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", nil, core.NewStatusError(504, "Timeout processing image")
+		}
+
+		return "", nil, ctx.Err()
+	case result := <-result:
+		return result.imageType, result.imageBlob, result.err
+	}
+}
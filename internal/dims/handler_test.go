@@ -0,0 +1,62 @@
+package dims
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/beetlebugorg/go-dims/internal/core"
+	"github.com/davidbyttow/govips/v2/vips"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowRenderer renders with a detached request, once it is unblocked.
+type slowRenderer struct {
+	*Request
+	unblock chan struct{}
+	done    chan struct{}
+}
+
+func (r *slowRenderer) ProcessImage(ctx context.Context, image *vips.ImageRef, errorImage bool) (string, []byte, error) {
+	defer close(r.done)
+	<-r.unblock
+
+	return r.Request.ProcessImage(ctx, image, errorImage)
+}
+
+func TestProcessImageTimeout(t *testing.T) {
+	u, _ := url.Parse("/v5/strip/true/?url=http://example.com/image.png")
+	request, err := NewRequest(context.Background(), u, "strip/true", core.Config{})
+	require.NoError(t, err)
+
+	sourceImage := &core.Image{Bytes: readinessImage, Format: vips.ImageTypePNG, Status: 200}
+	request.SourceImage = *sourceImage
+
+	released := make(chan struct{})
+	release := func() { close(released) }
+
+	renderer := &slowRenderer{Request: request.Detach(), unblock: make(chan struct{}), done: make(chan struct{})}
+	_, _, err = processImage(context.Background(), renderer, sourceImage, 10*time.Millisecond, release)
+
+	var statusError *core.StatusError
+	require.True(t, errors.As(err, &statusError), "expected a StatusError, got %v", err)
+	assert.Equal(t, 504, statusError.StatusCode)
+
+	select {
+	case <-released:
+		t.Fatal("admission released while the abandoned rendering is still running")
+	default:
+	}
+
+	// The abandoned rendering goes on with its own copy of the request, while the request
+	// sends its error response.
+	close(renderer.unblock)
+	request.DebugHeaders("png", nil)
+	<-renderer.done
+	<-released
+
+	assert.Empty(t, request.Timings().String(), "the request doesn't get the abandoned timings")
+}
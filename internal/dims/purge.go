@@ -0,0 +1,131 @@
+package dims
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/beetlebugorg/go-dims/internal/cache"
+	"github.com/beetlebugorg/go-dims/internal/core"
+)
+
+type purgeResult struct {
+	Evicted int            `json:"evicted"`
+	Caches  map[string]int `json:"caches"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// Purge evicts the source image and every rendered image made from it from the caches,
+// returning how many entries each cache evicted. It fails if any cache couldn't be purged,
+// since that cache would go on serving the image.
+func (s *Service) Purge(ctx context.Context, source string) (map[string]int, error) {
+	for _, tiers := range s.tiers {
+		tiers.Purged(source)
+	}
+
+	return s.purge(func(purger cache.Purger) (int, error) {
+		return purger.PurgeSource(ctx, source)
+	})
+}
+
+// PurgeAll empties the caches, returning how many entries each cache evicted.
+func (s *Service) PurgeAll(ctx context.Context) (map[string]int, error) {
+	for _, tiers := range s.tiers {
+		tiers.PurgedAll()
+	}
+
+	return s.purge(func(purger cache.Purger) (int, error) {
+		return purger.PurgeAll(ctx)
+	})
+}
+
+// purge runs purge on every cache, the slowest first, so a lookup can't copy an entry from a
+// cache that hasn't been purged yet into one that has.
+func (s *Service) purge(purge func(purger cache.Purger) (int, error)) (map[string]int, error) {
+	counts := make(map[string]int, len(s.caches))
+	var errs []error
+	for i := len(s.caches) - 1; i >= 0; i-- {
+		named := s.caches[i]
+
+		purger, ok := named.cache.(cache.Purger)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s cache can't be purged", named.name))
+			continue
+		}
+
+		count, err := purge(purger)
+		counts[named.name] = count
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s cache: %w", named.name, err))
+		}
+	}
+
+	return counts, errors.Join(errs...)
+}
+
+// HandlePurge evicts cached images, responding with the number evicted as JSON. The source
+// image URL is given in the url parameter, or all=true empties the caches.
+func (s *Service) HandlePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	source := r.FormValue("url")
+	all := r.FormValue("all") == "true" || r.FormValue("all") == "1"
+
+	var counts map[string]int
+	var err error
+	switch {
+	case all:
+		counts, err = s.PurgeAll(r.Context())
+	case source != "":
+		counts, err = s.Purge(r.Context(), source)
+	default:
+		http.Error(w, "url or all=true is required", http.StatusBadRequest)
+		return
+	}
+
+	result := purgeResult{Caches: counts}
+	for _, count := range counts {
+		result.Evicted += count
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	// Some caches may still hold the image, the purge should be retried.
+	if err != nil {
+		slog.Error("purge failed", "url", source, "all", all, "evicted", result.Evicted, "error", err)
+
+		result.Error = err.Error()
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+
+	slog.Info("purge", "url", source, "all", all, "evicted", result.Evicted)
+
+	json.NewEncoder(w).Encode(result)
+}
+
+// RequireAdminToken only lets requests with the DIMS_ADMIN_TOKEN bearer token through.
+func RequireAdminToken(config core.Config, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || config.Admin.Token == "" ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(config.Admin.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
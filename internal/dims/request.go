@@ -6,7 +6,11 @@ import (
 	"github.com/beetlebugorg/go-dims/internal/commands"
 	"github.com/beetlebugorg/go-dims/internal/core"
 	"github.com/beetlebugorg/go-dims/internal/geometry"
+	"github.com/beetlebugorg/go-dims/internal/metrics"
+	"github.com/beetlebugorg/go-dims/internal/tracing"
 	"github.com/davidbyttow/govips/v2/vips"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
 	"log/slog"
 	"net/url"
 	"runtime/trace"
@@ -20,13 +24,19 @@ type Request struct {
 	SendContentDisposition bool              // The content disposition of the http.
 	RawCommands            string            // The commands ('resize/100x100', 'strip/true/format/png', etc).
 	Signature              string            // The signature of the request.
+	ClientID               string            // The v4 client id, empty for v5 requests.
 	SignedParams           map[string]string // The query parameters used to sign the request.
 	SourceImage            core.Image        // The source image.
 	config                 core.Config       // The global configuration.
+	fetcher                *core.Fetcher     // Fetches the source image, and any overlays.
+	ctx                    context.Context   // The context of the client request.
+	timings                *Timings          // The time taken by each stage of the request.
 	shrinkFactor           int
+	sourceWidth            int // The width of the source image, before it was shrunk on load.
+	sourceHeight           int // The height of the source image, before it was shrunk on load.
 }
 
-func NewRequest(url *url.URL, cmds string, config core.Config) (*Request, error) {
+func NewRequest(ctx context.Context, url *url.URL, cmds string, config core.Config) (*Request, error) {
 	imageUrl := url.Query().Get("url")
 	eurl := url.Query().Get("eurl")
 	if eurl != "" {
@@ -62,18 +72,80 @@ func NewRequest(url *url.URL, cmds string, config core.Config) (*Request, error)
 		SignedParams:           signedParams,
 		SendContentDisposition: sendContentDisposition,
 		config:                 config,
+		ctx:                    ctx,
+		timings:                &Timings{},
 	}, nil
 }
 
+// SourceURL returns the URL of the source image, after decrypting it if needed.
+func (r *Request) SourceURL() string {
+	return r.ImageUrl
+}
+
+// OutputFormat returns the output format asked for by the format command or configured with
+// DIMS_DEFAULT_OUTPUT_FORMAT, or an empty string when it follows the source image.
+func (r *Request) OutputFormat() string {
+	format := r.config.OutputFormat.Default
+	for _, command := range r.Commands() {
+		if command.Name == "format" {
+			if _, ok := core.ImageTypes[command.Args]; ok {
+				format = command.Args
+			}
+		}
+	}
+
+	return format
+}
+
 func (r *Request) Config() core.Config {
 	return r.config
 }
 
+// Context returns the context of the client request. It is canceled when the client goes away.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+
+	return r.ctx
+}
+
+// Detach returns a copy of the request to render the image with. Rendering can outlive the
+// request when processing times out, so the copy has its own timings and no client context.
+func (r *Request) Detach() *Request {
+	detached := *r
+	detached.ctx = nil
+	detached.timings = &Timings{}
+
+	return &detached
+}
+
+// Merge records the timings and shrink factor of a rendering done with a detached copy of the
+// request, once it has finished. Each request waiting on a shared render merges it into its own
+// timings, on its own goroutine.
+func (r *Request) Merge(renderer *Request) {
+	r.timings.Merge(renderer.timings)
+	r.shrinkFactor = renderer.shrinkFactor
+}
+
 func (r *Request) LoadImage(sourceImage *core.Image) (*vips.ImageRef, error) {
+	start := time.Now()
+	defer func() {
+		r.timings.Add("load", "", time.Since(start))
+	}()
+
 	image, err := vips.NewImageFromBuffer(sourceImage.Bytes)
 	if err != nil {
 		return nil, err
 	}
+
+	// Only the header has been read at this point, reject images that would be too large
+	// to decode. For SVG images this is the size they will be rasterized at.
+	if err := core.CheckInputDimensions(r.config.InputLimits, image.Width(), image.Height()); err != nil {
+		return nil, err
+	}
+	r.sourceWidth, r.sourceHeight = image.Width(), image.Height()
+
 	importParams := vips.NewImportParams()
 	importParams.AutoRotate.Set(true)
 
@@ -93,9 +165,7 @@ func (r *Request) LoadImage(sourceImage *core.Image) (*vips.ImageRef, error) {
 }
 
 // ProcessImage will execute the commands on the image.
-func (r *Request) ProcessImage(image *vips.ImageRef, errorImage bool) (string, []byte, error) {
-	ctx := context.Background()
-
+func (r *Request) ProcessImage(ctx context.Context, image *vips.ImageRef, errorImage bool) (string, []byte, error) {
 	// Execute the commands.
 	ctx, task := trace.NewTask(ctx, "v5.ProcessImage")
 	defer task.End()
@@ -114,30 +184,37 @@ func (r *Request) ProcessImage(image *vips.ImageRef, errorImage bool) (string, [
 	opts.TiffExportParams.StripMetadata = stripMetadata
 
 	for _, command := range r.Commands() {
-		region := trace.StartRegion(ctx, command.Name)
-
-		if operation, ok := commands.VipsTransformCommands[command.Name]; ok {
-			if command.Name == "strip" && command.Args != "true" {
-				stripMetadata = false
-			}
+		// Stop early if the client has gone away or processing has timed out.
+		if err := ctx.Err(); err != nil {
+			return "", nil, err
+		}
 
-			if err := operation(image, command.Args); err != nil && !errorImage {
-				return "", nil, err
-			}
-		} else if operation, ok := commands.VipsExportCommands[command.Name]; ok {
-			if err := operation(image, command.Args, &opts); err != nil && !errorImage {
-				return "", nil, err
-			}
-		} else if operation, ok := commands.VipsRequestCommands[command.Name]; ok && !errorImage {
-			if err := operation(image, command.Args, commands.RequestOperation{
-				Config: r.config,
-				URL:    r.URL,
-			}); err != nil {
-				return "", nil, err
-			}
+		if command.Name == "strip" && command.Args != "true" {
+			stripMetadata = false
 		}
 
+		region := trace.StartRegion(ctx, command.Name)
+		commandCtx, span := tracing.Tracer.Start(ctx, command.Name, oteltrace.WithAttributes(
+			attribute.String("dims.command.name", command.Name),
+			attribute.String("dims.command.args", command.Args),
+		))
+		start := time.Now()
+
+		err := r.executeCommand(commandCtx, image, command, &opts, errorImage)
+		tracing.End(span, err)
 		region.End()
+		if err != nil {
+			return "", nil, err
+		}
+
+		if !errorImage {
+			metrics.CommandDuration.WithLabelValues(command.Name).Observe(time.Since(start).Seconds())
+			r.timings.Add(command.Name, command.Args, time.Since(start))
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return "", nil, err
 	}
 
 	if stripMetadata {
@@ -146,47 +223,89 @@ func (r *Request) ProcessImage(image *vips.ImageRef, errorImage bool) (string, [
 		}
 	}
 
-	switch opts.ImageType {
-	case vips.ImageTypeJPEG:
-		imageBytes, _, err := image.ExportJpeg(opts.JpegExportParams)
-		if err != nil {
-			return "", nil, err
-		}
-
-		return vips.ImageTypes[vips.ImageTypeJPEG], imageBytes, nil
+	_, span := tracing.Tracer.Start(ctx, "encode")
+	start := time.Now()
+	imageType, imageBytes, err := exportImage(image, opts)
+	if err == nil {
+		span.SetAttributes(
+			attribute.String("dims.output.format", imageType),
+			attribute.Int("dims.output.size", len(imageBytes)),
+		)
+	}
+	tracing.End(span, err)
+	if err != nil {
+		return "", nil, err
+	}
 
-	case vips.ImageTypePNG:
-		imageBytes, _, err := image.ExportPng(opts.PngExportParams)
-		if err != nil {
-			return "", nil, err
-		}
+	if !errorImage {
+		metrics.ExportDuration.WithLabelValues(imageType).Observe(time.Since(start).Seconds())
+		r.timings.Add("export", imageType, time.Since(start))
+		metrics.ExportBytes.WithLabelValues(imageType).Observe(float64(len(imageBytes)))
+	}
 
-		return vips.ImageTypes[vips.ImageTypePNG], imageBytes, nil
+	return imageType, imageBytes, nil
+}
 
-	case vips.ImageTypeWEBP:
-		imageBytes, _, err := image.ExportWebp(opts.WebpExportParams)
-		if err != nil {
-			return "", nil, err
+// executeCommand runs a single command. Errors are ignored when rendering an error image, so
+// that a bad command doesn't stop the error from being sent.
+func (r *Request) executeCommand(ctx context.Context, image *vips.ImageRef, command commands.Command, opts *commands.ExportOptions, errorImage bool) error {
+	if operation, ok := commands.VipsTransformCommands[command.Name]; ok {
+		if err := operation(image, command.Args); err != nil && !errorImage {
+			return err
+		}
+	} else if operation, ok := commands.VipsExportCommands[command.Name]; ok {
+		if err := operation(image, command.Args, opts); err != nil && !errorImage {
+			return err
 		}
+	} else if operation, ok := commands.VipsResizeCommands[command.Name]; ok {
+		data := r.requestOperation(ctx)
 
-		return vips.ImageTypes[vips.ImageTypeWEBP], imageBytes, nil
-	case vips.ImageTypeGIF:
-		imageBytes, _, err := image.ExportGIF(opts.GifExportParams)
-		if err != nil {
-			return "", nil, err
+		// Error images are sized from the error image itself.
+		if errorImage {
+			data.SourceWidth, data.SourceHeight = 0, 0
 		}
 
-		return vips.ImageTypes[vips.ImageTypeGIF], imageBytes, nil
-	case vips.ImageTypeTIFF:
-		imageBytes, _, err := image.ExportTiff(opts.TiffExportParams)
-		if err != nil {
-			return "", nil, err
+		if err := operation(image, command.Args, data); err != nil && !errorImage {
+			return err
 		}
+	} else if operation, ok := commands.VipsRequestCommands[command.Name]; ok && !errorImage {
+		return operation(image, command.Args, r.requestOperation(ctx))
+	}
+
+	return nil
+}
+
+func (r *Request) requestOperation(ctx context.Context) commands.RequestOperation {
+	return commands.RequestOperation{
+		Context:      ctx,
+		Config:       r.config,
+		Fetcher:      r.fetcher,
+		URL:          r.URL,
+		SourceWidth:  r.sourceWidth,
+		SourceHeight: r.sourceHeight,
+	}
+}
+
+// exportImage encodes the image in the output format, returning the format name and bytes.
+func exportImage(image *vips.ImageRef, opts commands.ExportOptions) (string, []byte, error) {
+	var imageBytes []byte
+	var err error
 
-		return vips.ImageTypes[vips.ImageTypeTIFF], imageBytes, nil
+	switch opts.ImageType {
+	case vips.ImageTypeJPEG:
+		imageBytes, _, err = image.ExportJpeg(opts.JpegExportParams)
+	case vips.ImageTypePNG:
+		imageBytes, _, err = image.ExportPng(opts.PngExportParams)
+	case vips.ImageTypeWEBP:
+		imageBytes, _, err = image.ExportWebp(opts.WebpExportParams)
+	case vips.ImageTypeGIF:
+		imageBytes, _, err = image.ExportGIF(opts.GifExportParams)
+	case vips.ImageTypeTIFF:
+		imageBytes, _, err = image.ExportTiff(opts.TiffExportParams)
+	default:
+		imageBytes, _, err = image.ExportNative()
 	}
 
-	imageBytes, _, err := image.ExportNative()
 	if err != nil {
 		return "", nil, err
 	}
@@ -194,8 +313,12 @@ func (r *Request) ProcessImage(image *vips.ImageRef, errorImage bool) (string, [
 	return vips.ImageTypes[opts.ImageType], imageBytes, nil
 }
 
-func (r *Request) FetchImage(timeout time.Duration) (*core.Image, error) {
-	image, err := core.FetchImage(r.ImageUrl, timeout)
+func (r *Request) FetchImage(ctx context.Context, fetcher *core.Fetcher, timeout time.Duration) (*core.Image, error) {
+	r.fetcher = fetcher
+
+	start := time.Now()
+	image, err := fetcher.FetchImage(ctx, r.ImageUrl, timeout)
+	r.timings.Add("fetch", "", time.Since(start))
 	if err != nil {
 		return nil, err
 	}
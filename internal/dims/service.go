@@ -0,0 +1,112 @@
+package dims
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/beetlebugorg/go-dims/internal/admission"
+	"github.com/beetlebugorg/go-dims/internal/cache"
+	"github.com/beetlebugorg/go-dims/internal/coalesce"
+	"github.com/beetlebugorg/go-dims/internal/core"
+	"github.com/beetlebugorg/go-dims/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Service is the state shared by the requests of one handler, i.e. its admission limiter,
+// source fetcher, render cache, and whether it is draining.
+//
+// Services don't share any state, so handlers with different configurations can run in the
+// same process.
+type Service struct {
+	config      core.Config
+	limiter     *admission.Limiter
+	fetcher     *core.Fetcher
+	renderCache cache.Cache
+	renders     coalesce.Group[renderResult] // Concurrent renders of the same image, by render key.
+	draining    atomic.Bool
+	working     sync.WaitGroup       // The admitted work, which may still be using libvips.
+	caches      []namedCache         // Every cache, the fastest first, purged by the admin endpoint.
+	tiers       []*cache.Tiers       // The render and source cache tiers, which are told about purges.
+	registry    *prometheus.Registry // The service's own metrics.
+	vars        map[string]func() any
+}
+
+// namedCache is a cache along with the name its purges are reported under.
+type namedCache struct {
+	name  string
+	cache cache.Cache
+}
+
+// NewService returns the service for a handler with the given configuration.
+func NewService(config core.Config) *Service {
+	s := &Service{
+		config:   config,
+		registry: prometheus.NewRegistry(),
+		vars:     make(map[string]func() any),
+	}
+
+	s.limiter = admission.NewLimiter(config.Admission.Capacity, config.Admission.MaxQueue,
+		time.Duration(config.Admission.QueueTimeout)*time.Millisecond)
+	s.publish("admission", func() any { return s.limiter.Stats() })
+	s.registry.MustRegister(s.admissionCollectors()...)
+
+	s.setupCaches()
+
+	return s
+}
+
+// Flush waits for the caches that write in the background, i.e. the bucket cache. It must be
+// called before the process exits, or is frozen at the end of a Lambda invocation.
+func (s *Service) Flush() {
+	for _, named := range s.caches {
+		if flusher, ok := named.cache.(cache.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+}
+
+// Gatherer returns the service's metrics, along with the ones shared by the whole process.
+func (s *Service) Gatherer() prometheus.Gatherer {
+	return prometheus.Gatherers{metrics.Registry, s.registry}
+}
+
+// publish makes a stat available through HandleDebugVars.
+func (s *Service) publish(name string, value func() any) {
+	s.vars[name] = value
+}
+
+// HandleDebugVars serves the expvar variables, i.e. memory stats, along with the service's
+// admission and cache stats, in the format of expvar.Handler.
+func (s *Service) HandleDebugVars(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	fmt.Fprintf(w, "{\n")
+	first := true
+	write := func(name string, value string) {
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+
+		fmt.Fprintf(w, "%q: %s", name, value)
+	}
+
+	expvar.Do(func(kv expvar.KeyValue) {
+		write(kv.Key, kv.Value.String())
+	})
+
+	for name, value := range s.vars {
+		encoded, err := json.Marshal(value())
+		if err != nil {
+			continue
+		}
+		write(name, string(encoded))
+	}
+
+	fmt.Fprintf(w, "\n}\n")
+}
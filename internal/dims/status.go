@@ -1,11 +1,195 @@
 package dims
 
 import (
-	"github.com/beetlebugorg/go-dims/internal/core"
+	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
+	"sort"
+	"time"
+
+	"github.com/beetlebugorg/go-dims/internal/admission"
+	"github.com/beetlebugorg/go-dims/internal/commands"
+	"github.com/beetlebugorg/go-dims/internal/core"
+	"github.com/davidbyttow/govips/v2/vips"
 )
 
-func HandleDimsStatus(config core.Config, w http.ResponseWriter, r *http.Request) {
+// Drain marks the service as shutting down. From then on status checks report that the
+// service is not ready, so load balancers stop sending it new requests.
+func (s *Service) Drain() {
+	s.draining.Store(true)
+}
+
+func (s *Service) HandleDimsStatus(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		w.WriteHeader(503)
+		w.Write([]byte("DRAINING"))
+		return
+	}
+
 	w.WriteHeader(200)
 	w.Write([]byte("ALIVE"))
 }
+
+// HandleLiveness reports that the process is running. It keeps succeeding while draining, so
+// that the process isn't restarted while it finishes in-flight requests.
+func HandleLiveness(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(200)
+	w.Write([]byte("ALIVE"))
+}
+
+// readinessImage is a 2x2 PNG that is processed by every readiness check.
+var readinessImage = []byte{
+	0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d, 0x49, 0x48, 0x44, 0x52,
+	0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x02, 0x08, 0x02, 0x00, 0x00, 0x00, 0xfd, 0xd4, 0x9a,
+	0x73, 0x00, 0x00, 0x00, 0x11, 0x49, 0x44, 0x41, 0x54, 0x78, 0xda, 0x63, 0xf8, 0xcf, 0xc0, 0x00,
+	0x44, 0x0c, 0x60, 0xf2, 0x3f, 0x00, 0x1b, 0xf2, 0x03, 0xfd, 0x8e, 0x08, 0xd4, 0xaf, 0x00, 0x00,
+	0x00, 0x00, 0x49, 0x45, 0x4e, 0x44, 0xae, 0x42, 0x60, 0x82,
+}
+
+// The output formats that go-dims can save, checked by exporting the readiness image.
+var saveFormats = []vips.ImageType{
+	vips.ImageTypeJPEG,
+	vips.ImageTypePNG,
+	vips.ImageTypeWEBP,
+	vips.ImageTypeGIF,
+	vips.ImageTypeTIFF,
+}
+
+type readinessStatus struct {
+	Status  string           `json:"status"`
+	Checks  map[string]check `json:"checks"`
+	Libvips string           `json:"libvips"`
+	Formats formats          `json:"formats"`
+}
+
+type check struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type formats struct {
+	Load []string `json:"load"`
+	Save []string `json:"save"`
+}
+
+// HandleReadiness reports whether the service can serve images, as JSON. It runs a small image
+// through the pipeline, and checks the source backends when DIMS_READY_CHECK_SOURCES is set.
+func (s *Service) HandleReadiness(w http.ResponseWriter, r *http.Request) {
+	config := s.config
+
+	status := readinessStatus{
+		Status:  "ready",
+		Checks:  make(map[string]check),
+		Libvips: vips.Version,
+	}
+
+	fail := func(name string, err error) {
+		status.Status = "not ready"
+		status.Checks[name] = check{Status: "failed", Error: err.Error()}
+	}
+
+	if s.draining.Load() {
+		fail("draining", errors.New("shutting down"))
+	}
+
+	status.Formats.Load = loadFormats()
+
+	// The pipeline check is admitted like any other render, so it doesn't add to the load of a
+	// busy service. It is skipped when the service is saturated, since that is only temporary.
+	release, err := s.acquire(r.Context(), 1)
+	if errors.Is(err, admission.ErrSaturated) {
+		status.Checks["pipeline"] = check{Status: "skipped"}
+	} else if err != nil {
+		fail("pipeline", err)
+	} else {
+		saved, err := checkPipeline()
+		release()
+
+		status.Formats.Save = saved
+		if err != nil {
+			fail("pipeline", err)
+		} else {
+			status.Checks["pipeline"] = check{Status: "ok"}
+		}
+	}
+
+	if config.Readiness.CheckSources {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(config.Timeout.Download)*time.Millisecond)
+		defer cancel()
+
+		for name, err := range s.fetcher.CheckSourceBackends(ctx) {
+			name = "source:" + name
+			if errors.Is(err, core.ErrHealthCheckSkipped) {
+				status.Checks[name] = check{Status: "skipped"}
+			} else if err != nil {
+				fail(name, err)
+			} else {
+				status.Checks[name] = check{Status: "ok"}
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status.Status != "ready" {
+		w.WriteHeader(503)
+	} else {
+		w.WriteHeader(200)
+	}
+
+	json.NewEncoder(w).Encode(status)
+}
+
+// loadFormats returns the image formats the linked libvips can load.
+func loadFormats() []string {
+	loaders := make(map[string]bool)
+	for imageType, name := range vips.ImageTypes {
+		if vips.IsTypeSupported(imageType) {
+			loaders[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(loaders))
+	for name := range loaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// checkPipeline decodes, resizes, and encodes the readiness image, returning the output formats
+// it could be saved in. It fails if the image can't be processed or saved as a JPEG, the format
+// used for error images.
+func checkPipeline() ([]string, error) {
+	image, err := vips.LoadImageFromBuffer(readinessImage, vips.NewImportParams())
+	if err != nil {
+		return nil, err
+	}
+	defer image.Close()
+
+	if err := commands.ResizeCommand(image, "1x1", commands.RequestOperation{}); err != nil {
+		return nil, err
+	}
+
+	saved := make([]string, 0, len(saveFormats))
+	var jpegErr error
+	for _, imageType := range saveFormats {
+		_, _, err := exportImage(image, commands.ExportOptions{
+			ImageType:        imageType,
+			JpegExportParams: vips.NewJpegExportParams(),
+			PngExportParams:  vips.NewPngExportParams(),
+			WebpExportParams: vips.NewWebpExportParams(),
+			GifExportParams:  vips.NewGifExportParams(),
+			TiffExportParams: vips.NewTiffExportParams(),
+		})
+		if err == nil {
+			saved = append(saved, vips.ImageTypes[imageType])
+		} else if imageType == vips.ImageTypeJPEG {
+			jpegErr = err
+		}
+	}
+
+	return saved, jpegErr
+}
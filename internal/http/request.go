@@ -5,15 +5,18 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"github.com/beetlebugorg/go-dims/internal/accesslog"
+	"github.com/beetlebugorg/go-dims/internal/cache"
+	"github.com/beetlebugorg/go-dims/internal/cachecontrol"
 	"github.com/beetlebugorg/go-dims/internal/commands"
 	"github.com/beetlebugorg/go-dims/internal/core"
 	"github.com/beetlebugorg/go-dims/internal/dims"
+	"github.com/beetlebugorg/go-dims/internal/surrogatekey"
 	"hash"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -34,7 +37,7 @@ func NewRequest(r *http.Request, w http.ResponseWriter, config core.Config) (*Re
 	requestUrl := r.URL
 	cmds := r.PathValue("commands")
 
-	request, err := dims.NewRequest(requestUrl, cmds, config)
+	request, err := dims.NewRequest(r.Context(), requestUrl, cmds, config)
 
 	return &Request{
 		Request:      *request,
@@ -52,45 +55,48 @@ func (r *Request) HashId() string {
 }
 
 func (r *Request) SendHeaders() {
-	w := r.httpResponse
-
-	cacheControl := r.CacheControl()
-	if cacheControl != "" {
-		w.Header().Set("Cache-Control", cacheControl)
+	for key, value := range dims.ResponseHeaders(r) {
+		r.httpResponse.Header().Set(key, value)
 	}
+}
 
-	expires := r.Expires()
-	if expires != "" {
-		w.Header().Set("Expires", expires)
+func (r *Request) SendImage(status int, imageFormat string, imageBlob []byte) error {
+	if imageBlob == nil {
+		return fmt.Errorf("image is empty")
 	}
 
-	edgeControl := r.EdgeControl()
-	if edgeControl != "" {
-		w.Header().Set("Edge-Control", edgeControl)
+	if status == http.StatusOK {
+		r.SendHeaders()
 	}
 
-	contentDisposition := r.ContentDisposition()
-	if contentDisposition != "" {
-		w.Header().Set("Content-Disposition", contentDisposition)
-	}
+	return r.writeImage(status, imageFormat, imageBlob)
+}
 
-	etag := r.Etag()
-	if etag != "" {
-		w.Header().Set("ETag", etag)
+// SendCached sends a rendered image from the cache, with the headers it was first sent with.
+func (r *Request) SendCached(entry *cache.Entry) error {
+	for key, value := range entry.Headers {
+		r.httpResponse.Header().Set(key, value)
 	}
 
-	if r.LastModified() != "" {
-		w.Header().Set("Last-Modified", r.LastModified())
-	}
+	r.httpResponse.Header().Set("Age", strconv.Itoa(int(time.Since(entry.Created).Seconds())))
+
+	return r.writeImage(http.StatusOK, entry.Format, entry.Body)
 }
 
-func (r *Request) SendImage(status int, imageFormat string, imageBlob []byte) error {
-	if imageBlob == nil {
-		return fmt.Errorf("image is empty")
+// SendNotModified tells the client its copy of the image is still current.
+func (r *Request) SendNotModified(headers map[string]string) error {
+	for key, value := range headers {
+		r.httpResponse.Header().Set(key, value)
 	}
 
-	if status == http.StatusOK {
-		r.SendHeaders()
+	r.httpResponse.WriteHeader(http.StatusNotModified)
+
+	return nil
+}
+
+func (r *Request) writeImage(status int, imageFormat string, imageBlob []byte) error {
+	for key, value := range r.DebugHeaders(imageFormat, imageBlob) {
+		r.httpResponse.Header().Set(key, value)
 	}
 
 	// Set content type.
@@ -119,7 +125,7 @@ func (r *Request) SendError(err error) error {
 		message = message[0:strings.Index(message, "\n")]
 	}
 
-	slog.Error("SendError", "message", message)
+	slog.Error("SendError", "message", message, "request_id", accesslog.RequestID(r.Context()))
 
 	// Set status code.
 	status := http.StatusInternalServerError
@@ -127,6 +133,10 @@ func (r *Request) SendError(err error) error {
 	var operationError *commands.OperationError
 	if errors.As(err, &statusError) {
 		status = statusError.StatusCode
+
+		if statusError.RetryAfter > 0 {
+			r.httpResponse.Header().Set("Retry-After", strconv.Itoa(statusError.RetryAfter))
+		}
 	} else if errors.As(err, &operationError) {
 		status = operationError.StatusCode
 	}
@@ -137,13 +147,15 @@ func (r *Request) SendError(err error) error {
 	}
 
 	// Send error headers.
-	maxAge := r.Config().OriginCacheControl.Error
-	if maxAge > 0 {
-		r.httpResponse.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, public", maxAge))
-		r.httpResponse.Header().Set("Expires", time.Now().Add(time.Duration(maxAge)*time.Second).UTC().Format(http.TimeFormat))
+	for key, value := range dims.ErrorHeaders(r.Config()) {
+		r.httpResponse.Header().Set(key, value)
+	}
+
+	if header, keys := r.SurrogateKey(); header != "" {
+		r.httpResponse.Header().Set(header, keys)
 	}
 
-	imageType, imageBlob, err := r.ProcessImage(errorImage, true)
+	imageType, imageBlob, err := r.ProcessImage(r.Context(), errorImage, true)
 	if err != nil {
 		// If processing failed because of a bad command then return the image as-is.
 		exportOptions := vips.NewJpegExportParams()
@@ -160,17 +172,70 @@ func (r *Request) SendError(err error) error {
 	return r.SendImage(status, imageType, imageBlob)
 }
 
+//-- Conditional Interface
+
+func (r *Request) IfNoneMatch() string {
+	return r.httpRequest.Header.Get("If-None-Match")
+}
+
+func (r *Request) IfModifiedSince() string {
+	return r.httpRequest.Header.Get("If-Modified-Since")
+}
+
 //-- Headers Interface
 
+// MaxAge is how long, in seconds, the rendered image may be cached.
+func (r *Request) MaxAge() int {
+	return r.calculateMaxAge()
+}
+
 func (r *Request) CacheControl() string {
+	if origin, ok := r.originCacheControl(); ok {
+		switch {
+		case origin.NoStore:
+			return "no-store"
+		case origin.NoCache:
+			return "no-cache"
+		case origin.Private:
+			return cachecontrol.Header{MaxAge: r.clampMaxAge(origin.TTL), Private: true}.String()
+		}
+	}
+
 	maxAge := r.calculateMaxAge()
 	if maxAge > 0 {
-		return fmt.Sprintf("max-age=%d, public", r.calculateMaxAge())
+		return dims.SuccessCacheControl(r.Config(), maxAge).String()
 	}
 
 	return ""
 }
 
+// SurrogateControl is the Cache-Control header for CDNs, i.e. Fastly, when DIMS_SURROGATE_CONTROL is set.
+func (r *Request) SurrogateControl() string {
+	if !r.Config().EdgeControl.SurrogateControl {
+		return ""
+	}
+
+	return r.targetedCacheControl()
+}
+
+// CDNCacheControl is the Cache-Control header for CDNs (RFC 9213), when DIMS_CDN_CACHE_CONTROL is set.
+func (r *Request) CDNCacheControl() string {
+	if !r.Config().EdgeControl.CDNCacheControl {
+		return ""
+	}
+
+	return r.targetedCacheControl()
+}
+
+func (r *Request) targetedCacheControl() string {
+	maxAge := r.calculateMaxAge()
+	if maxAge <= 0 {
+		return ""
+	}
+
+	return dims.SuccessCacheControl(r.Config(), maxAge).Targeted()
+}
+
 func (r *Request) Etag() string {
 	if r.SourceImage.Etag != "" {
 		var h hash.Hash
@@ -213,6 +278,19 @@ func (r *Request) EdgeControl() string {
 	return ""
 }
 
+// SurrogateKey returns the DIMS_SURROGATE_KEY_HEADER header and its keys, used to purge every
+// variant of the source image from a CDN, or empty strings when it is disabled.
+func (r *Request) SurrogateKey() (string, string) {
+	header := r.Config().SurrogateKeys.Header
+	if header == "" {
+		return "", ""
+	}
+
+	keys := surrogatekey.Keys(r.ImageUrl, r.ClientID, r.SignedParams[r.Config().SurrogateKeys.TagParam])
+
+	return header, surrogatekey.Format(header, keys)
+}
+
 func (r *Request) ContentDisposition() string {
 	if r.SendContentDisposition {
 		// Grab filename from imageUrl
@@ -229,46 +307,31 @@ func (r *Request) ContentDisposition() string {
 	return ""
 }
 
+// calculateMaxAge returns how long shared caches may keep the rendered image. Images the origin
+// doesn't allow shared caches to store have a max-age of 0.
 func (r *Request) calculateMaxAge() int {
-	maxAge := r.Config().OriginCacheControl.Default
-
-	if r.Config().OriginCacheControl.UseOrigin {
-		originMaxAge, err := sourceMaxAge(r.SourceImage.CacheControl)
-		if err == nil {
-			maxAge = originMaxAge
-
-			// If below minimum, set to minimum.
-			minCacheAge := r.Config().OriginCacheControl.Min
-			if minCacheAge != 0 && maxAge <= minCacheAge {
-				maxAge = minCacheAge
-			}
-
-			// If above maximum, set to maximum.
-			maxCacheAge := r.Config().OriginCacheControl.Max
-			if maxCacheAge != 0 && maxAge >= maxCacheAge {
-				maxAge = maxCacheAge
-			}
-		}
+	origin, ok := r.originCacheControl()
+	if !ok {
+		return r.Config().OriginCacheControl.Default
 	}
 
-	return maxAge
-}
-
-func sourceMaxAge(header string) (int, error) {
-	if header == "" {
-		return 0, errors.New("empty header")
+	if origin.NoStore || origin.NoCache || origin.Private {
+		return 0
 	}
 
-	pattern, _ := regexp.Compile(`max-age=(\d+)`)
-	match := pattern.FindStringSubmatch(header)
-	if len(match) == 1 {
-		sourceMaxAge, err := strconv.Atoi(match[0])
-		if err != nil {
-			return 0, errors.New("unable to convert to int")
-		}
+	return r.clampMaxAge(origin.TTL)
+}
 
-		return sourceMaxAge, nil
+// originCacheControl interprets the source image's caching headers, when
+// DIMS_CACHE_CONTROL_USE_ORIGIN is set.
+func (r *Request) originCacheControl() (cachecontrol.Origin, bool) {
+	if !r.Config().OriginCacheControl.UseOrigin {
+		return cachecontrol.Origin{}, false
 	}
 
-	return 0, errors.New("max-age not found in header")
+	return cachecontrol.FromHeaders(r.SourceImage.CacheControl, r.SourceImage.Expires, time.Now())
+}
+
+func (r *Request) clampMaxAge(maxAge int) int {
+	return cachecontrol.Clamp(maxAge, r.Config().OriginCacheControl.Min, r.Config().OriginCacheControl.Max)
 }
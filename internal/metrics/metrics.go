@@ -0,0 +1,152 @@
+// Package metrics defines the Prometheus metrics exported by go-dims.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "dims"
+
+// Registry holds every go-dims metric, along with the Go runtime and process metrics.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// Requests counts requests by endpoint (v4, v5) and response status code.
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Image requests by endpoint and status code.",
+	}, []string{"endpoint", "code"})
+
+	// RequestDuration tracks the total time to serve a request, by endpoint.
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time to serve an image request, by endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	// RequestsInFlight tracks the number of image requests currently being served.
+	RequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "requests_in_flight",
+		Help:      "Image requests currently being served.",
+	})
+
+	// SignatureFailures counts requests rejected because of an invalid signature.
+	SignatureFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "signature_failures_total",
+		Help:      "Requests rejected because of an invalid signature.",
+	})
+
+	// SourceFetchDuration tracks the time to fetch source images, by backend.
+	SourceFetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "source_fetch_duration_seconds",
+		Help:      "Time to fetch a source image, by backend.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend"})
+
+	// SourceBytes tracks the size of fetched source images, by backend.
+	SourceBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "source_size_bytes",
+		Help:      "Size of fetched source images, by backend.",
+		Buckets:   prometheus.ExponentialBuckets(16*1024, 4, 8),
+	}, []string{"backend"})
+
+	// SourceRevalidations counts conditional requests for cached source images, by backend and
+	// result (modified, not_modified).
+	SourceRevalidations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "source_revalidations_total",
+		Help:      "Conditional requests for cached source images, by backend and result.",
+	}, []string{"backend", "result"})
+
+	// Coalesced counts requests that shared a fetch or render already in progress, by level
+	// (fetch, render).
+	Coalesced = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "coalesced_total",
+		Help:      "Requests that shared a fetch or render already in progress.",
+	}, []string{"level"})
+
+	// PeerFetches counts rendered images requested from the peer that owns them, by result
+	// (hit, rejected, error).
+	PeerFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "peer_fetches_total",
+		Help:      "Rendered images requested from the owning peer, by result.",
+	}, []string{"result"})
+
+	// PeerEjections counts peers removed from the hash ring after failing health checks.
+	PeerEjections = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "peer_ejections_total",
+		Help:      "Peers removed from the hash ring after repeated failures.",
+	})
+
+	// CommandDuration tracks the time to execute each command, by command name.
+	CommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "command_duration_seconds",
+		Help:      "Time to execute a command, by command name.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"command"})
+
+	// ExportDuration tracks the time to encode the output image, by format.
+	ExportDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "export_duration_seconds",
+		Help:      "Time to encode an output image, by format.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"format"})
+
+	// ExportBytes tracks the size of output images, by format.
+	ExportBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "export_size_bytes",
+		Help:      "Size of output images, by format.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 8),
+	}, []string{"format"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Requests,
+		RequestDuration,
+		RequestsInFlight,
+		SignatureFailures,
+		SourceFetchDuration,
+		SourceBytes,
+		SourceRevalidations,
+		Coalesced,
+		PeerFetches,
+		PeerEjections,
+		CommandDuration,
+		ExportDuration,
+		ExportBytes,
+	)
+}
+
+// Handler serves the metrics gathered by gatherer in the Prometheus text format, i.e. Registry
+// along with the metrics of one image handler.
+func Handler(gatherer prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// InstrumentHandler records the request count, duration, and in-flight gauge for an endpoint.
+func InstrumentHandler(endpoint string, next http.Handler) http.Handler {
+	labels := prometheus.Labels{"endpoint": endpoint}
+
+	return promhttp.InstrumentHandlerInFlight(RequestsInFlight,
+		promhttp.InstrumentHandlerDuration(RequestDuration.MustCurryWith(labels),
+			promhttp.InstrumentHandlerCounter(Requests.MustCurryWith(labels), next)))
+}
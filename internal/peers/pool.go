@@ -0,0 +1,486 @@
+// Package peers shares rendered images between replicas. The replicas form a consistent hash
+// ring, each render key is owned by one of them, and the others ask the owner for the image over
+// HTTP, so each image is rendered and cached by one replica instead of all of them.
+package peers
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/beetlebugorg/go-dims/internal/accesslog"
+	"github.com/beetlebugorg/go-dims/internal/cache"
+	"github.com/beetlebugorg/go-dims/internal/cachecontrol"
+	"github.com/beetlebugorg/go-dims/internal/coalesce"
+	"github.com/beetlebugorg/go-dims/internal/core"
+	"github.com/beetlebugorg/go-dims/internal/metrics"
+)
+
+// PeerHeader marks requests forwarded by another peer, and holds the peers' shared secret.
+// They are always handled locally, so a request is forwarded at most once, even while peers
+// disagree about who owns it.
+const PeerHeader = "X-Dims-Peer"
+
+// Pool is the set of peers, as seen by one instance. Peers that fail their health checks, or
+// fail to send an image, are ejected from the ring until they pass a health check again.
+//
+// Health checks and DNS lookups run in the background when a lookup finds them due, so an idle
+// pool does no work.
+type Pool struct {
+	self    string
+	config  core.Peers
+	client  *http.Client
+	resolve func(ctx context.Context) ([]string, error) // Nil for a static list.
+	now     func() time.Time
+
+	ring atomic.Pointer[Ring]
+
+	mu          sync.Mutex
+	members     []string // Every known peer, including self, sorted.
+	failures    map[string]int
+	ejected     map[string]bool
+	lastCheck   time.Time
+	lastRefresh time.Time
+	checking    bool
+
+	fetches coalesce.Group[*cache.Entry]
+}
+
+// NewPool returns the pool described by the configuration, or nil if neither a peer list nor a
+// DNS name is configured.
+func NewPool(config core.Peers) (*Pool, error) {
+	if len(config.List) == 0 && config.DNS == "" {
+		return nil, nil
+	}
+
+	self, err := peerURL(config.Self)
+	if err != nil {
+		return nil, fmt.Errorf("DIMS_PEERS_SELF: %w", err)
+	}
+
+	// Without a secret anyone could send the peer header, and have any instance render any
+	// image.
+	if config.Secret == "" {
+		return nil, errors.New("DIMS_PEERS_SECRET is required")
+	}
+
+	p := &Pool{
+		self:     self,
+		config:   config,
+		client:   &http.Client{},
+		now:      time.Now,
+		failures: make(map[string]int),
+		ejected:  make(map[string]bool),
+	}
+
+	members := []string{self}
+	if config.DNS != "" {
+		host, port, err := net.SplitHostPort(config.DNS)
+		if err != nil {
+			return nil, fmt.Errorf("DIMS_PEERS_DNS: %w", err)
+		}
+
+		scheme := strings.SplitN(self, "://", 2)[0]
+		p.resolve = func(ctx context.Context) ([]string, error) {
+			addresses, err := net.DefaultResolver.LookupHost(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+
+			peers := make([]string, 0, len(addresses))
+			for _, address := range addresses {
+				peers = append(peers, scheme+"://"+net.JoinHostPort(address, port))
+			}
+
+			return peers, nil
+		}
+	} else {
+		for _, peer := range config.List {
+			peer, err := peerURL(peer)
+			if err != nil {
+				return nil, fmt.Errorf("DIMS_PEERS: %w", err)
+			}
+
+			members = append(members, peer)
+		}
+	}
+
+	p.setMembers(members)
+
+	if p.resolve != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Timeout)*time.Millisecond)
+		defer cancel()
+
+		p.refresh(ctx)
+	}
+
+	return p, nil
+}
+
+// Owner returns the peer owning key, and whether it is another instance.
+func (p *Pool) Owner(key string) (string, bool) {
+	p.maintain()
+
+	owner := p.ring.Load().Owner(key)
+
+	return owner, owner != "" && owner != p.self
+}
+
+// Fetch asks owner for the rendered image at target, the path and query of the image request.
+//
+// A 4xx response from the owner is returned as a *core.StatusError, since rendering the image
+// locally would fail the same way.
+func (p *Pool) Fetch(ctx context.Context, owner string, target string) (*cache.Entry, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.config.Timeout)*time.Millisecond)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, owner+target, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set(PeerHeader, p.config.Secret)
+	if requestID := accesslog.RequestID(ctx); requestID != "" {
+		request.Header.Set(accesslog.RequestIDHeader, requestID)
+	}
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		p.record(owner, err)
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	// Other errors, i.e. a missing source image, are the image's fault, not the peer's.
+	if response.StatusCode == http.StatusServiceUnavailable {
+		err := fmt.Errorf("peer %s responded %s", owner, response.Status)
+		p.record(owner, err)
+		return nil, err
+	}
+
+	if response.StatusCode >= 400 && response.StatusCode < 500 {
+		_, _ = io.Copy(io.Discard, response.Body)
+		p.record(owner, nil)
+		return nil, &core.StatusError{
+			StatusCode: response.StatusCode,
+			Message:    "peer " + owner + " responded " + response.Status,
+		}
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer %s responded %s", owner, response.Status)
+	}
+
+	body, err := p.readBody(response)
+	if err != nil {
+		p.record(owner, err)
+		return nil, err
+	}
+
+	p.record(owner, nil)
+
+	// Too large an image is the image's fault, it is rendered locally instead.
+	if maxBytes := p.config.MaxBytes; maxBytes > 0 && int64(len(body)) > maxBytes {
+		return nil, fmt.Errorf("peer %s sent more than %d bytes", owner, maxBytes)
+	}
+
+	return entryFromResponse(response, body, p.now()), nil
+}
+
+// readBody reads the image from the response, stopping one byte past DIMS_PEERS_MAX_BYTES.
+func (p *Pool) readBody(response *http.Response) ([]byte, error) {
+	if p.config.MaxBytes <= 0 {
+		return io.ReadAll(response.Body)
+	}
+
+	return io.ReadAll(io.LimitReader(response.Body, p.config.MaxBytes+1))
+}
+
+// Handler makes the pool available to the image handlers, through the request context.
+// Requests with the peers' secret in the peer header aren't forwarded.
+func (p *Pool) Handler(next http.Handler) http.Handler {
+	secret := []byte(p.config.Secret)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(PeerHeader)), secret) != 1 {
+			r = r.WithContext(context.WithValue(r.Context(), contextKey{}, &forward{
+				pool:   p,
+				target: r.URL.RequestURI(),
+			}))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type contextKey struct{}
+
+// forward is what's needed to forward a request to the owner of its image.
+type forward struct {
+	pool   *Pool
+	target string
+}
+
+// Lookup returns the rendered image for key from the peer that owns it. It reports false when
+// the request is handled locally: peers aren't enabled, this instance owns key, the request
+// came from a peer, or the owner couldn't be reached or failed with a 5xx.
+//
+// When the owner rejects the request with a 4xx, i.e. the source image doesn't exist, the
+// *core.StatusError is returned so the request fails without rendering it locally.
+//
+// Concurrent lookups of the same key share one request to the owner.
+func Lookup(ctx context.Context, key string) (*cache.Entry, bool, error) {
+	f, _ := ctx.Value(contextKey{}).(*forward)
+	if f == nil {
+		return nil, false, nil
+	}
+
+	owner, remote := f.pool.Owner(key)
+	if !remote {
+		return nil, false, nil
+	}
+
+	entry, _, err := f.pool.fetches.Do(ctx, key, func(ctx context.Context) (*cache.Entry, error) {
+		return f.pool.Fetch(ctx, owner, f.target)
+	})
+	var statusError *core.StatusError
+	if errors.As(err, &statusError) {
+		metrics.PeerFetches.WithLabelValues("rejected").Inc()
+		return nil, false, err
+	}
+
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			slog.Warn("peer fetch failed", "peer", owner, "error", err)
+		}
+		metrics.PeerFetches.WithLabelValues("error").Inc()
+		return nil, false, nil
+	}
+
+	metrics.PeerFetches.WithLabelValues("hit").Inc()
+
+	return entry, true, nil
+}
+
+// maintain starts a health check, and a DNS lookup, when they are due.
+func (p *Pool) maintain() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	if p.checking || now.Sub(p.lastCheck) < time.Duration(p.config.HealthInterval)*time.Second {
+		return
+	}
+
+	p.checking = true
+	p.lastCheck = now
+
+	refresh := p.resolve != nil && now.Sub(p.lastRefresh) >= time.Duration(p.config.RefreshInterval)*time.Second
+
+	go func() {
+		defer func() {
+			p.mu.Lock()
+			p.checking = false
+			p.mu.Unlock()
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.config.HealthInterval)*time.Second)
+		defer cancel()
+
+		if refresh {
+			p.refresh(ctx)
+		}
+
+		p.check(ctx)
+	}()
+}
+
+// check requests /healthz from every other peer. It fails while a peer is draining.
+func (p *Pool) check(ctx context.Context) {
+	p.mu.Lock()
+	peers := slices.Clone(p.members)
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		if peer == p.self {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			p.record(peer, p.checkPeer(ctx, peer))
+		}()
+	}
+
+	wg.Wait()
+}
+
+func (p *Pool) checkPeer(ctx context.Context, peer string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+"/healthz", nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set(PeerHeader, p.config.Secret)
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check responded %s", response.Status)
+	}
+
+	return nil
+}
+
+// record counts a failure or success of peer, ejecting it from the ring after too many
+// failures in a row, and adding it back after a success.
+func (p *Pool) record(peer string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil {
+		p.failures[peer] = 0
+		if p.ejected[peer] {
+			delete(p.ejected, peer)
+			slog.Info("peer readmitted", "peer", peer)
+			p.rebuild()
+		}
+		return
+	}
+
+	// Giving up on a request says nothing about the peer.
+	if errors.Is(err, context.Canceled) || !slices.Contains(p.members, peer) {
+		return
+	}
+
+	p.failures[peer]++
+	if p.failures[peer] >= p.config.FailureThreshold && !p.ejected[peer] {
+		p.ejected[peer] = true
+		metrics.PeerEjections.Inc()
+		slog.Warn("peer ejected", "peer", peer, "error", err)
+		p.rebuild()
+	}
+}
+
+// refresh replaces the peers with the addresses the DNS name resolves to, keeping the current
+// peers if the lookup fails.
+func (p *Pool) refresh(ctx context.Context) {
+	p.mu.Lock()
+	p.lastRefresh = p.now()
+	p.mu.Unlock()
+
+	peers, err := p.resolve(ctx)
+	if err != nil {
+		slog.Error("peer lookup failed", "dns", p.config.DNS, "error", err)
+		return
+	}
+
+	p.setMembers(append(peers, p.self))
+}
+
+// setMembers replaces the peers, forgetting the health of peers that are gone.
+func (p *Pool) setMembers(peers []string) {
+	slices.Sort(peers)
+	peers = slices.Compact(peers)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for peer := range p.failures {
+		if !slices.Contains(peers, peer) {
+			delete(p.failures, peer)
+			delete(p.ejected, peer)
+		}
+	}
+
+	p.members = peers
+	p.rebuild()
+}
+
+// rebuild places the healthy peers on a new ring. It is called with mu held.
+func (p *Pool) rebuild() {
+	healthy := make([]string, 0, len(p.members))
+	for _, peer := range p.members {
+		if !p.ejected[peer] {
+			healthy = append(healthy, peer)
+		}
+	}
+
+	p.ring.Store(NewRing(p.config.VirtualNodes, healthy...))
+}
+
+// entryFromResponse turns the owner's response back into the entry it was rendered as.
+func entryFromResponse(response *http.Response, body []byte, now time.Time) *cache.Entry {
+	headers := make(map[string]string)
+	for name := range response.Header {
+		if skipHeader(name) {
+			continue
+		}
+
+		// The handlers look up ETag in its usual spelling, not the canonical one.
+		key := name
+		if name == "Etag" {
+			key = "ETag"
+		}
+		headers[key] = response.Header.Get(name)
+	}
+
+	created := now
+	if age, err := strconv.Atoi(response.Header.Get("Age")); err == nil && age > 0 {
+		created = now.Add(-time.Duration(age) * time.Second)
+	}
+
+	origin, _ := cachecontrol.FromHeaders(headers["Cache-Control"], headers["Expires"], now)
+
+	return &cache.Entry{
+		Format:  strings.TrimPrefix(response.Header.Get("Content-Type"), "image/"),
+		Body:    body,
+		Headers: headers,
+		Created: created,
+		Expires: now.Add(time.Duration(origin.TTL) * time.Second),
+	}
+}
+
+// skipHeader is true for headers that are set for each response, rather than for the image.
+func skipHeader(name string) bool {
+	switch name {
+	case "Age", "Connection", "Content-Length", "Content-Type", "Date", "Keep-Alive", "Server-Timing",
+		"Transfer-Encoding", http.CanonicalHeaderKey(accesslog.RequestIDHeader):
+		return true
+	}
+
+	return strings.HasPrefix(name, "X-Dims-")
+}
+
+// peerURL checks that peer is an absolute URL, and drops any trailing slash.
+func peerURL(peer string) (string, error) {
+	u, err := url.Parse(peer)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("%q is not an absolute URL", peer)
+	}
+
+	return strings.TrimRight(peer, "/"), nil
+}
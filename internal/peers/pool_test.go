@@ -0,0 +1,272 @@
+package peers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"github.com/beetlebugorg/go-dims/internal/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// instance stands in for a replica: it serves images from its peers, or renders them itself.
+type instance struct {
+	server  *httptest.Server
+	pool    *Pool
+	renders atomic.Int32
+	health  atomic.Int32 // Status code of /healthz, 200 when unset.
+	status  atomic.Int32 // Status code of rendered images, 200 when unset.
+}
+
+func newInstances(t *testing.T, n int) []*instance {
+	instances := make([]*instance, n)
+	handlers := make([]http.Handler, n)
+
+	for i := range instances {
+		instances[i] = &instance{}
+		instances[i].server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers[i].ServeHTTP(w, r)
+		}))
+		t.Cleanup(instances[i].server.Close)
+	}
+
+	var urls []string
+	for _, in := range instances {
+		urls = append(urls, in.server.URL)
+	}
+
+	for i, in := range instances {
+		pool, err := NewPool(core.Peers{
+			Self:             in.server.URL,
+			List:             urls,
+			HealthInterval:   60,
+			FailureThreshold: 2,
+			Timeout:          1000,
+			VirtualNodes:     64,
+			Secret:           "secret",
+			MaxBytes:         1024,
+		})
+		require.NoError(t, err)
+		in.pool = pool
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			if status := in.health.Load(); status != 0 {
+				w.WriteHeader(int(status))
+			}
+		})
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			entry, ok, err := Lookup(r.Context(), r.URL.Path)
+			var statusError *core.StatusError
+			if errors.As(err, &statusError) {
+				w.WriteHeader(statusError.StatusCode)
+				return
+			}
+
+			if ok {
+				for name, value := range entry.Headers {
+					w.Header().Set(name, value)
+				}
+				w.Header().Set("Content-Type", "image/"+entry.Format)
+				_, _ = w.Write(entry.Body)
+				return
+			}
+
+			in.renders.Add(1)
+			if status := in.status.Load(); status != 0 {
+				w.WriteHeader(int(status))
+				return
+			}
+
+			w.Header().Set("Content-Type", "image/webp")
+			w.Header().Set("ETag", `"rendered"`)
+			w.Header().Set("Cache-Control", "max-age=60")
+			_, _ = w.Write([]byte("image " + r.URL.Path))
+		})
+		handlers[i] = pool.Handler(mux)
+	}
+
+	return instances
+}
+
+func get(t *testing.T, url string) *http.Response {
+	response, err := http.Get(url)
+	require.NoError(t, err)
+	t.Cleanup(func() { response.Body.Close() })
+
+	return response
+}
+
+func TestPoolRendersOnce(t *testing.T) {
+	instances := newInstances(t, 3)
+
+	for _, in := range instances {
+		response := get(t, in.server.URL+"/v5/resize/100x100")
+		body, _ := io.ReadAll(response.Body)
+
+		assert.Equal(t, 200, response.StatusCode)
+		assert.Equal(t, "image /v5/resize/100x100", string(body))
+		assert.Equal(t, `"rendered"`, response.Header.Get("ETag"))
+		assert.Equal(t, "image/webp", response.Header.Get("Content-Type"))
+	}
+
+	owner, _ := instances[0].pool.Owner("/v5/resize/100x100")
+	for _, in := range instances {
+		if in.server.URL == owner {
+			assert.Equal(t, int32(3), in.renders.Load())
+		} else {
+			assert.Equal(t, int32(0), in.renders.Load())
+		}
+	}
+}
+
+// ownedBy returns a key owned by owner, as seen by self.
+func ownedBy(self *instance, owner *instance) string {
+	for i := 0; ; i++ {
+		key := "/v5/resize/" + string(rune('a'+i))
+		if peer, _ := self.pool.Owner(key); peer == owner.server.URL {
+			return key
+		}
+	}
+}
+
+func TestPoolPassesThroughClientErrors(t *testing.T) {
+	instances := newInstances(t, 2)
+	self, owner := instances[0], instances[1]
+	owner.status.Store(404)
+
+	response := get(t, self.server.URL+ownedBy(self, owner))
+
+	assert.Equal(t, 404, response.StatusCode)
+	assert.Equal(t, int32(0), self.renders.Load(), "the owner's 4xx isn't rendered again")
+	assert.Equal(t, int32(1), owner.renders.Load())
+	assert.Len(t, ringPeers(self.pool), 2, "a 4xx doesn't count against the owner")
+}
+
+func TestPoolFallsBackOnServerErrors(t *testing.T) {
+	instances := newInstances(t, 2)
+	self, owner := instances[0], instances[1]
+	owner.status.Store(500)
+
+	response := get(t, self.server.URL+ownedBy(self, owner))
+
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, int32(1), self.renders.Load(), "the image is rendered locally")
+	assert.Equal(t, int32(1), owner.renders.Load())
+}
+
+func TestPoolDoesNotForwardPeerRequests(t *testing.T) {
+	instances := newInstances(t, 2)
+
+	key := "/v5/resize/100x100"
+	owner, _ := instances[0].pool.Owner(key)
+	for _, in := range instances {
+		if in.server.URL == owner {
+			continue
+		}
+
+		request, _ := http.NewRequest("GET", in.server.URL+key, nil)
+		request.Header.Set(PeerHeader, "secret")
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		response.Body.Close()
+
+		assert.Equal(t, int32(1), in.renders.Load())
+	}
+}
+
+func TestPoolForwardsRequestsWithoutSecret(t *testing.T) {
+	instances := newInstances(t, 2)
+	self, owner := instances[0], instances[1]
+
+	// A client can't make an instance render an image it doesn't own.
+	for _, secret := range []string{owner.server.URL, "wrong", ""} {
+		request, _ := http.NewRequest("GET", self.server.URL+ownedBy(self, owner), nil)
+		request.Header.Set(PeerHeader, secret)
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		response.Body.Close()
+	}
+
+	assert.Equal(t, int32(0), self.renders.Load())
+	assert.Equal(t, int32(3), owner.renders.Load())
+}
+
+func TestPoolLimitsImageSize(t *testing.T) {
+	instances := newInstances(t, 2)
+	self, owner := instances[0], instances[1]
+	self.pool.config.MaxBytes = 5
+
+	response := get(t, self.server.URL+ownedBy(self, owner))
+
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, int32(1), self.renders.Load(), "the image is rendered locally")
+	assert.Len(t, ringPeers(self.pool), 2, "a large image doesn't count against the owner")
+}
+
+func TestPoolEjectsUnhealthyPeers(t *testing.T) {
+	instances := newInstances(t, 2)
+	self, peer := instances[0], instances[1]
+	ctx := context.Background()
+
+	peer.health.Store(503)
+	self.pool.check(ctx)
+	assert.Len(t, ringPeers(self.pool), 2, "one failure is tolerated")
+
+	self.pool.check(ctx)
+	assert.Equal(t, []string{self.server.URL}, ringPeers(self.pool))
+
+	peer.health.Store(200)
+	self.pool.check(ctx)
+	assert.Len(t, ringPeers(self.pool), 2, "a passing health check readmits the peer")
+}
+
+// ringPeers returns the peers on the pool's ring.
+func ringPeers(pool *Pool) []string {
+	var peers []string
+	for _, peer := range pool.ring.Load().owners {
+		if !slices.Contains(peers, peer) {
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers
+}
+
+func TestPoolEjectsUnreachablePeers(t *testing.T) {
+	instances := newInstances(t, 2)
+	self, peer := instances[0], instances[1]
+	peer.server.Close()
+
+	// Every request for a key the closed peer owns falls back to rendering locally.
+	key := ownedBy(self, peer)
+
+	for i := 0; i < 3; i++ {
+		response := get(t, self.server.URL+key)
+		assert.Equal(t, 200, response.StatusCode)
+	}
+
+	assert.Equal(t, int32(3), self.renders.Load())
+
+	owner, remote := self.pool.Owner(key)
+	assert.Equal(t, self.server.URL, owner)
+	assert.False(t, remote)
+}
+
+func TestNewPoolDisabled(t *testing.T) {
+	pool, err := NewPool(core.Peers{})
+	assert.NoError(t, err)
+	assert.Nil(t, pool)
+
+	_, err = NewPool(core.Peers{List: []string{"http://a"}})
+	assert.Error(t, err, "DIMS_PEERS_SELF is required")
+
+	_, err = NewPool(core.Peers{Self: "http://a", List: []string{"http://a"}})
+	assert.Error(t, err, "DIMS_PEERS_SECRET is required")
+}
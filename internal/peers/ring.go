@@ -0,0 +1,50 @@
+package peers
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// Ring is a consistent hash ring, mapping each key to one peer. Adding or removing a peer only
+// moves the keys next to its points on the ring, the rest keep their owner.
+type Ring struct {
+	points []uint32          // Sorted.
+	owners map[uint32]string // Peer at each point.
+}
+
+// NewRing places each peer on the ring at virtualNodes points, which spreads keys evenly.
+func NewRing(virtualNodes int, peers ...string) *Ring {
+	r := &Ring{owners: make(map[uint32]string, len(peers)*virtualNodes)}
+
+	for _, peer := range peers {
+		for i := 0; i < virtualNodes; i++ {
+			point := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + peer))
+			if _, taken := r.owners[point]; taken {
+				continue
+			}
+
+			r.owners[point] = peer
+			r.points = append(r.points, point)
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+
+	return r
+}
+
+// Owner returns the peer owning key, or an empty string if the ring is empty.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.owners[r.points[i]]
+}
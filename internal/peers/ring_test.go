@@ -0,0 +1,38 @@
+package peers
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingEmpty(t *testing.T) {
+	assert.Equal(t, "", NewRing(64).Owner("render:jpeg:abc"))
+}
+
+func TestRingSpreadsKeys(t *testing.T) {
+	ring := NewRing(64, "http://a", "http://b", "http://c")
+
+	owned := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		owned[ring.Owner(fmt.Sprintf("render:jpeg:%d", i))]++
+	}
+
+	assert.Len(t, owned, 3)
+	for peer, keys := range owned {
+		assert.Greater(t, keys, 500, peer)
+	}
+}
+
+func TestRingKeepsOwnersWhenPeerRemoved(t *testing.T) {
+	before := NewRing(64, "http://a", "http://b", "http://c")
+	after := NewRing(64, "http://a", "http://b")
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("render:jpeg:%d", i)
+		if owner := before.Owner(key); owner != "http://c" {
+			assert.Equal(t, owner, after.Owner(key), key)
+		}
+	}
+}
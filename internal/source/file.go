@@ -6,11 +6,9 @@ import (
 	"github.com/beetlebugorg/go-dims/internal/core"
 	"github.com/caarlos0/env/v10"
 	"github.com/davidbyttow/govips/v2/vips"
-	"io"
 	"os"
 	"path/filepath"
 	"strings"
-	"time"
 )
 
 type fileSourceBackend struct {
@@ -46,7 +44,7 @@ func (f fileSourceBackend) CanHandle(imageSource string) bool {
 	return false
 }
 
-func (f fileSourceBackend) FetchImage(imageSource string, timeout time.Duration) (*core.Image, error) {
+func (f fileSourceBackend) FetchImage(ctx context.Context, imageSource string) (*core.Image, error) {
 	var path string
 	if strings.HasPrefix(imageSource, "file://../") {
 		path = strings.TrimPrefix(imageSource, "file://../")
@@ -57,7 +55,7 @@ func (f fileSourceBackend) FetchImage(imageSource string, timeout time.Duration)
 	path = filepath.Clean(path)
 	path = filepath.Join(f.baseDir, path)
 
-	imageBytes, err := readFileWithTimeout(path, timeout)
+	imageBytes, err := readFile(ctx, path)
 	if err != nil {
 		return nil, err
 	}
@@ -70,12 +68,24 @@ func (f fileSourceBackend) FetchImage(imageSource string, timeout time.Duration)
 	}, nil
 }
 
-func readFileWithTimeout(path string, timeout time.Duration) ([]byte, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+// CheckHealth checks that the base directory exists.
+func (f fileSourceBackend) CheckHealth(ctx context.Context) error {
+	info, err := os.Stat(f.baseDir)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", f.baseDir)
+	}
 
-	result := make(chan []byte)
-	errCh := make(chan error)
+	return nil
+}
+
+// readFile reads the file at path, giving up as soon as ctx is done.
+func readFile(ctx context.Context, path string) ([]byte, error) {
+	result := make(chan []byte, 1)
+	errCh := make(chan error, 1)
 
 	go func() {
 		file, err := os.Open(path)
@@ -85,7 +95,12 @@ func readFileWithTimeout(path string, timeout time.Duration) ([]byte, error) {
 		}
 		defer file.Close()
 
-		data, err := io.ReadAll(file)
+		size := int64(-1)
+		if info, err := file.Stat(); err == nil {
+			size = info.Size()
+		}
+
+		data, err := core.ReadImage(ctx, file, size)
 		if err != nil {
 			errCh <- err
 			return
@@ -95,7 +110,7 @@ func readFileWithTimeout(path string, timeout time.Duration) ([]byte, error) {
 
 	select {
 	case <-ctx.Done():
-		return nil, core.NewStatusError(504, "Timeout reading file")
+		return nil, ctx.Err()
 	case err := <-errCh:
 		return nil, err
 	case data := <-result:
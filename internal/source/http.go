@@ -1,26 +1,72 @@
 package source
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/beetlebugorg/go-dims/internal/accesslog"
 	"github.com/beetlebugorg/go-dims/internal/core"
+	"github.com/beetlebugorg/go-dims/internal/tracing"
 	"github.com/davidbyttow/govips/v2/vips"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 )
 
+// maxErrorBodyBytes is how much of an error response is read before the connection is closed.
+const maxErrorBodyBytes = 64 * 1024
+
 type httpSourceBackend struct {
+	policy         originPolicy
+	client         *http.Client
+	healthCheckURL string
 }
 
 func init() {
-	core.RegisterImageBackend(NewHttpSourceBackend())
+	core.RegisterSourceBackendFactory(func(config core.Config) core.SourceBackend {
+		return NewHttpSourceBackend(config.HttpSource)
+	})
 }
 
-func NewHttpSourceBackend() core.SourceBackend {
-	return httpSourceBackend{}
+func NewHttpSourceBackend(config core.HttpSource) core.SourceBackend {
+	policy := newOriginPolicy(config)
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   policy.control,
+	}
+
+	// Connect to origins directly, a proxy from the environment would dial the origin on our
+	// behalf and skip the origin policy's address checks.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+
+	return httpSourceBackend{
+		policy:         policy,
+		healthCheckURL: config.HealthCheckURL,
+		client: &http.Client{
+			Transport: transport,
+			CheckRedirect: func(request *http.Request, via []*http.Request) error {
+				if len(via) > policy.maxRedirects {
+					return core.NewStatusError(502, fmt.Sprintf("Image source redirected more than %d times", policy.maxRedirects))
+				}
+
+				if request.URL.Scheme != "http" && request.URL.Scheme != "https" {
+					return core.NewStatusError(403, "Image source redirected to unsupported scheme: "+request.URL.Scheme)
+				}
+
+				return policy.checkHost(request.URL.Hostname())
+			},
+		},
+	}
 }
 
 func (backend httpSourceBackend) Name() string {
@@ -35,29 +81,121 @@ func (backend httpSourceBackend) CanHandle(imageSource string) bool {
 	return false
 }
 
-func (backend httpSourceBackend) FetchImage(imageUrl string, timeout time.Duration) (*core.Image, error) {
+// CheckHealth requests DIMS_HTTP_HEALTH_CHECK_URL, if set, through the origin policy.
+func (backend httpSourceBackend) CheckHealth(ctx context.Context) error {
+	if backend.healthCheckURL == "" {
+		return core.ErrHealthCheckSkipped
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "HEAD", backend.healthCheckURL, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := backend.policy.checkHost(request.URL.Hostname()); err != nil {
+		return err
+	}
+
+	request.Header.Set("User-Agent", fmt.Sprintf("go-dims/%s", core.Version))
+
+	response, err := backend.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode >= 400 {
+		return fmt.Errorf("%s returned %d", backend.healthCheckURL, response.StatusCode)
+	}
+
+	return nil
+}
+
+func (backend httpSourceBackend) FetchImage(ctx context.Context, imageUrl string) (*core.Image, error) {
+	return backend.fetch(ctx, imageUrl, nil)
+}
+
+// RevalidateImage sends a conditional GET with the cached image's ETag and Last-Modified
+// headers, reusing the cached image if the origin responds 304 Not Modified.
+func (backend httpSourceBackend) RevalidateImage(ctx context.Context, imageUrl string, cached *core.Image) (*core.Image, error) {
+	return backend.fetch(ctx, imageUrl, cached)
+}
+
+func (backend httpSourceBackend) fetch(ctx context.Context, imageUrl string, cached *core.Image) (*core.Image, error) {
 	slog.Debug("downloadImage", "url", imageUrl)
 
-	_, err := url.ParseRequestURI(imageUrl)
+	u, err := url.ParseRequestURI(imageUrl)
 	if err != nil {
 		return nil, err
 	}
 
-	request, err := http.NewRequest("GET", imageUrl, nil)
+	if err := backend.policy.checkHost(u.Hostname()); err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "GET", imageUrl, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	request.Header.Set("User-Agent", fmt.Sprintf("go-dims/%s", core.Version))
+	if requestID := accesslog.RequestID(ctx); requestID != "" {
+		request.Header.Set(accesslog.RequestIDHeader, requestID)
+	}
+
+	if cached != nil {
+		if cached.Etag != "" {
+			request.Header.Set("If-None-Match", cached.Etag)
+		}
+
+		if cached.LastModified != "" {
+			request.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
 
-	http.DefaultClient.Timeout = timeout
-	image, err := http.DefaultClient.Do(request)
+	// Continue the trace at the origin.
+	ctx, span := tracing.Tracer.Start(ctx, "GET", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", "GET"),
+			attribute.String("url.full", imageUrl),
+			attribute.String("server.address", u.Hostname()),
+		))
+	tracing.Inject(ctx, request.Header)
+
+	image, err := backend.client.Do(request)
+	if err == nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", image.StatusCode))
+	}
+	tracing.End(span, err)
 	if err != nil {
+		// Origin policy violations are wrapped by the client, unwrap them so they are
+		// reported with the right status.
+		var statusError *core.StatusError
+		if errors.As(err, &statusError) {
+			return nil, statusError
+		}
+
 		return nil, err
 	}
+	defer image.Body.Close()
+
+	if cached != nil && image.StatusCode == http.StatusNotModified {
+		return cached.Revalidate(image.Header.Get("Cache-Control"), image.Header.Get("Edge-Control")), nil
+	}
+
+	// Error responses are reported with the origin's status, whatever their size. Only a little
+	// of the body is read, so the connection can be reused.
+	if image.StatusCode != 200 {
+		_, _ = io.Copy(io.Discard, io.LimitReader(image.Body, maxErrorBodyBytes))
+
+		return nil, &core.StatusError{
+			Message:    fmt.Sprintf("failed to fetch image from %s", imageUrl),
+			StatusCode: image.StatusCode,
+		}
+	}
 
 	imageSize := int(image.ContentLength)
-	imageBytes, err := io.ReadAll(image.Body)
+	imageBytes, err := core.ReadImage(ctx, image.Body, image.ContentLength)
 	if err != nil {
 		return nil, err
 	}
@@ -66,6 +204,7 @@ func (backend httpSourceBackend) FetchImage(imageUrl string, timeout time.Durati
 		Status:       image.StatusCode,
 		EdgeControl:  image.Header.Get("Edge-Control"),
 		CacheControl: image.Header.Get("Cache-Control"),
+		Expires:      image.Header.Get("Expires"),
 		LastModified: image.Header.Get("Last-Modified"),
 		Etag:         image.Header.Get("Etag"),
 		Format:       vips.DetermineImageType(imageBytes),
@@ -73,12 +212,5 @@ func (backend httpSourceBackend) FetchImage(imageUrl string, timeout time.Durati
 		Bytes:        imageBytes,
 	}
 
-	if image.StatusCode != 200 {
-		return nil, &core.StatusError{
-			Message:    fmt.Sprintf("failed to fetch image from %s", imageUrl),
-			StatusCode: image.StatusCode,
-		}
-	}
-
 	return &sourceImage, nil
 }
@@ -0,0 +1,114 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/beetlebugorg/go-dims/internal/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHttpSourceIgnoresProxyEnvironment(t *testing.T) {
+	backend := NewHttpSourceBackend(core.HttpSource{}).(httpSourceBackend)
+
+	// A proxy would dial the origin on our behalf, skipping the address checks.
+	transport := backend.client.Transport.(*http.Transport)
+	assert.Nil(t, transport.Proxy)
+}
+
+func TestHttpSourceRevalidate(t *testing.T) {
+	var ifNoneMatch, ifModifiedSince string
+	etag := `"v1"`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifNoneMatch = r.Header.Get("If-None-Match")
+		ifModifiedSince = r.Header.Get("If-Modified-Since")
+
+		w.Header().Set("Cache-Control", "max-age=60")
+		if ifNoneMatch == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Etag", `"v2"`)
+		_, _ = w.Write([]byte("new image"))
+	}))
+	defer server.Close()
+
+	backend := NewHttpSourceBackend(core.HttpSource{AllowPrivateNetworks: true}).(core.Revalidator)
+	cached := &core.Image{
+		Status:       200,
+		Bytes:        []byte("cached image"),
+		Etag:         etag,
+		LastModified: "Wed, 21 Oct 2015 07:28:00 GMT",
+		CacheControl: "max-age=10",
+	}
+
+	image, err := backend.RevalidateImage(context.Background(), server.URL+"/image.jpg", cached)
+	require.NoError(t, err)
+
+	assert.Equal(t, etag, ifNoneMatch)
+	assert.Equal(t, cached.LastModified, ifModifiedSince)
+	assert.True(t, image.Revalidated)
+	assert.Equal(t, cached.Bytes, image.Bytes)
+	assert.Equal(t, etag, image.Etag)
+	assert.Equal(t, "max-age=60", image.CacheControl)
+	assert.False(t, cached.Revalidated, "the cached image must not be modified")
+
+	// The image changed at the origin.
+	etag = `"v0"`
+	image, err = backend.RevalidateImage(context.Background(), server.URL+"/image.jpg", cached)
+	require.NoError(t, err)
+
+	assert.False(t, image.Revalidated)
+	assert.Equal(t, []byte("new image"), image.Bytes)
+	assert.Equal(t, `"v2"`, image.Etag)
+}
+
+func TestHttpSourceErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write(make([]byte, 1<<20))
+	}))
+	defer server.Close()
+
+	fetcher := core.NewFetcher(core.Config{
+		Source:     core.Source{Default: "http", MaxBytes: 1000},
+		HttpSource: core.HttpSource{AllowPrivateNetworks: true},
+	}, nil)
+
+	// The origin's error is reported, not the size of its error page.
+	_, err := fetcher.FetchImage(context.Background(), server.URL+"/missing.jpg", time.Second)
+	var statusError *core.StatusError
+	require.True(t, errors.As(err, &statusError), "expected a StatusError, got %v", err)
+	assert.Equal(t, 404, statusError.StatusCode)
+}
+
+func TestHttpSourceConfig(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	// Each fetcher's http backend uses the origin policy from its configuration.
+	for _, allowPrivateNetworks := range []bool{false, true} {
+		fetcher := core.NewFetcher(core.Config{
+			Source:     core.Source{Default: "http"},
+			HttpSource: core.HttpSource{AllowPrivateNetworks: allowPrivateNetworks},
+		}, nil)
+
+		_, err := fetcher.FetchImage(context.Background(), server.URL+"/image.jpg", time.Second)
+		var statusError *core.StatusError
+		require.True(t, errors.As(err, &statusError), "expected a StatusError, got %v", err)
+		if allowPrivateNetworks {
+			assert.Equal(t, 404, statusError.StatusCode)
+		} else {
+			assert.Equal(t, 403, statusError.StatusCode)
+		}
+	}
+}
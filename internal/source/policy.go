@@ -0,0 +1,137 @@
+package source
+
+import (
+	"fmt"
+	"net/netip"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/beetlebugorg/go-dims/internal/core"
+)
+
+// originPolicy decides which origins the http source backend may fetch from.
+//
+// Hosts are checked against the allow and deny patterns before every request, including
+// redirects. Addresses are checked after DNS resolution, right before connecting, so a
+// public hostname that resolves to a private address is still blocked.
+type originPolicy struct {
+	allowedHosts         []string
+	deniedHosts          []string
+	allowPrivateNetworks bool
+	maxRedirects         int
+}
+
+func newOriginPolicy(config core.HttpSource) originPolicy {
+	return originPolicy{
+		allowedHosts:         normalizeHostPatterns(config.AllowedHosts),
+		deniedHosts:          normalizeHostPatterns(config.DeniedHosts),
+		allowPrivateNetworks: config.AllowPrivateNetworks,
+		maxRedirects:         config.MaxRedirects,
+	}
+}
+
+// checkHost verifies the host is allowed. Denied patterns take precedence over allowed
+// patterns, and if any allowed patterns are configured the host must match one of them.
+//
+// Patterns use path.Match syntax, i.e. "*.example.com" or "images-?.example.com".
+func (p originPolicy) checkHost(host string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if matchHost(p.deniedHosts, host) {
+		return core.NewStatusError(403, fmt.Sprintf("Image source host '%s' is not allowed", host))
+	}
+
+	if len(p.allowedHosts) > 0 && !matchHost(p.allowedHosts, host) {
+		return core.NewStatusError(403, fmt.Sprintf("Image source host '%s' is not allowed", host))
+	}
+
+	return nil
+}
+
+// checkAddress verifies the resolved address is not in a private, loopback, link-local,
+// or otherwise non-public network. IPv6 addresses that reach an IPv4 address, through
+// NAT64 or 6to4, must also reach a public one.
+func (p originPolicy) checkAddress(addr netip.Addr) error {
+	if p.allowPrivateNetworks {
+		return nil
+	}
+
+	addr = addr.Unmap()
+	if !isPublicAddress(addr) {
+		return core.NewStatusError(403, fmt.Sprintf("Image source address '%s' is not allowed", addr))
+	}
+
+	if embedded, ok := embeddedIPv4(addr); ok && !isPublicAddress(embedded) {
+		return core.NewStatusError(403, fmt.Sprintf("Image source address '%s' is not allowed", addr))
+	}
+
+	return nil
+}
+
+// control is used as the net.Dialer Control function so every connection, including
+// those made while following redirects, is checked after DNS resolution.
+func (p originPolicy) control(network string, address string, c syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+
+	return p.checkAddress(addrPort.Addr())
+}
+
+func normalizeHostPatterns(patterns []string) []string {
+	normalized := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern != "" {
+			normalized = append(normalized, pattern)
+		}
+	}
+
+	return normalized
+}
+
+func matchHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, host); err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+var (
+	// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), which is not covered by
+	// netip.Addr.IsPrivate.
+	sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+	// localNAT64 is the local-use NAT64 prefix (RFC 8215), which translates to networks we
+	// can't see.
+	localNAT64 = netip.MustParsePrefix("64:ff9b:1::/48")
+
+	nat64      = netip.MustParsePrefix("64:ff9b::/96") // RFC 6052, the IPv4 address is the last 32 bits.
+	sixToFour  = netip.MustParsePrefix("2002::/16")    // RFC 3056, the IPv4 address follows the prefix.
+	ipv4Compat = netip.MustParsePrefix("::/96")        // RFC 4291, deprecated IPv4-compatible addresses.
+)
+
+func isPublicAddress(addr netip.Addr) bool {
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr) &&
+		!localNAT64.Contains(addr)
+}
+
+// embeddedIPv4 returns the IPv4 address an IPv6 address is translated or tunneled to.
+func embeddedIPv4(addr netip.Addr) (netip.Addr, bool) {
+	bytes := addr.As16()
+	switch {
+	case !addr.Is6():
+		return netip.Addr{}, false
+	case nat64.Contains(addr), ipv4Compat.Contains(addr):
+		return netip.AddrFrom4([4]byte(bytes[12:16])), true
+	case sixToFour.Contains(addr):
+		return netip.AddrFrom4([4]byte(bytes[2:6])), true
+	}
+
+	return netip.Addr{}, false
+}
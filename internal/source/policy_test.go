@@ -0,0 +1,118 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/beetlebugorg/go-dims/internal/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOriginPolicyHosts(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		denied  []string
+		host    string
+		allow   bool
+	}{
+		{nil, nil, "example.com", true},
+		{[]string{"example.com"}, nil, "example.com", true},
+		{[]string{"example.com"}, nil, "EXAMPLE.com.", true},
+		{[]string{"example.com"}, nil, "images.example.com", false},
+		{[]string{"*.example.com"}, nil, "images.example.com", true},
+		{[]string{"*.example.com"}, nil, "example.com", false},
+		{[]string{"images-?.example.com"}, nil, "images-1.example.com", true},
+		{nil, []string{"metadata.google.internal"}, "metadata.google.internal", false},
+		{[]string{"*.example.com"}, []string{"private.example.com"}, "private.example.com", false},
+		{[]string{"*.example.com"}, []string{"private.example.com"}, "public.example.com", true},
+	}
+
+	for _, test := range tests {
+		policy := newOriginPolicy(core.HttpSource{AllowedHosts: test.allowed, DeniedHosts: test.denied})
+
+		err := policy.checkHost(test.host)
+		if test.allow {
+			assert.NoError(t, err, "host %s, allowed %v, denied %v", test.host, test.allowed, test.denied)
+		} else {
+			assert.Error(t, err, "host %s, allowed %v, denied %v", test.host, test.allowed, test.denied)
+		}
+	}
+}
+
+func TestOriginPolicyAddresses(t *testing.T) {
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.1.2.3", false},
+		{"::127.0.0.1", false},
+		{"64:ff9b::93.184.216.34", true},
+		{"64:ff9b::127.0.0.1", false},
+		{"64:ff9b::169.254.169.254", false},
+		{"64:ff9b:1::93.184.216.34", false},
+		{"2002:5db8:d822::1", true},
+		{"2002:a01:203::1", false},
+		{"2002:7f00:1::1", false},
+	}
+
+	policy := newOriginPolicy(core.HttpSource{})
+	for _, test := range tests {
+		err := policy.checkAddress(netip.MustParseAddr(test.address))
+		if test.allowed {
+			assert.NoError(t, err, test.address)
+		} else {
+			assert.Error(t, err, test.address)
+		}
+	}
+
+	policy = newOriginPolicy(core.HttpSource{AllowPrivateNetworks: true})
+	assert.NoError(t, policy.checkAddress(netip.MustParseAddr("127.0.0.1")))
+}
+
+func TestHttpSourceBlocksLoopback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	backend := NewHttpSourceBackend(core.HttpSource{MaxRedirects: 5})
+
+	_, err := backend.FetchImage(context.Background(), server.URL+"/image.jpg")
+
+	var statusError *core.StatusError
+	require.True(t, errors.As(err, &statusError), "expected a StatusError, got %v", err)
+	assert.Equal(t, 403, statusError.StatusCode)
+}
+
+func TestHttpSourceMaxRedirects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	}))
+	defer server.Close()
+
+	backend := NewHttpSourceBackend(core.HttpSource{AllowPrivateNetworks: true, MaxRedirects: 2})
+
+	_, err := backend.FetchImage(context.Background(), server.URL+"/image.jpg")
+
+	var statusError *core.StatusError
+	require.True(t, errors.As(err, &statusError), "expected a StatusError, got %v", err)
+	assert.Equal(t, 502, statusError.StatusCode)
+}
@@ -2,6 +2,7 @@ package source
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -9,12 +10,10 @@ import (
 	"github.com/beetlebugorg/go-dims/internal/core"
 	"github.com/caarlos0/env/v10"
 	"github.com/davidbyttow/govips/v2/vips"
-	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"strings"
-	"time"
 )
 
 var client *s3.Client
@@ -57,7 +56,37 @@ func (backend s3SourceBackend) CanHandle(imageSource string) bool {
 	return false
 }
 
-func (backend s3SourceBackend) FetchImage(imageSource string, timeout time.Duration) (*core.Image, error) {
+// CheckHealth checks that the default bucket is accessible, or that credentials can be loaded
+// if there is no default bucket.
+func (backend s3SourceBackend) CheckHealth(ctx context.Context) error {
+	if backend.Config.Bucket == "" {
+		credentials := client.Options().Credentials
+		if credentials == nil {
+			return errors.New("no AWS credentials configured")
+		}
+
+		_, err := credentials.Retrieve(ctx)
+		return err
+	}
+
+	_, err := client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(backend.Config.Bucket),
+	})
+
+	return err
+}
+
+func (backend s3SourceBackend) FetchImage(ctx context.Context, imageSource string) (*core.Image, error) {
+	return backend.fetch(ctx, imageSource, nil)
+}
+
+// RevalidateImage gets the object only if its ETag no longer matches the cached image, reusing
+// the cached image if S3 responds 304 Not Modified.
+func (backend s3SourceBackend) RevalidateImage(ctx context.Context, imageSource string, cached *core.Image) (*core.Image, error) {
+	return backend.fetch(ctx, imageSource, cached)
+}
+
+func (backend s3SourceBackend) fetch(ctx context.Context, imageSource string, cached *core.Image) (*core.Image, error) {
 	slog.Info("downloadImageS3", "url", imageSource)
 
 	bucketName := backend.Config.Bucket
@@ -73,19 +102,41 @@ func (backend s3SourceBackend) FetchImage(imageSource string, timeout time.Durat
 		key = strings.TrimPrefix(u.Path, "/")
 	}
 
-	response, err := client.GetObject(context.TODO(), &s3.GetObjectInput{
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(bucketName),
 		Key:    aws.String(key),
-	})
+	}
+
+	if cached != nil {
+		if cached.Etag != "" {
+			input.IfNoneMatch = aws.String(cached.Etag)
+		} else if lastModified, err := http.ParseTime(cached.LastModified); err == nil {
+			input.IfModifiedSince = aws.Time(lastModified)
+		}
+	}
+
+	response, err := client.GetObject(ctx, input)
+
+	// S3 reports 304 Not Modified as an error.
+	var statusError interface{ HTTPStatusCode() int }
+	if cached != nil && errors.As(err, &statusError) && statusError.HTTPStatusCode() == http.StatusNotModified {
+		return cached.Revalidate("", ""), nil
+	}
 
 	if err != nil {
 		slog.Debug("s3.GetObject failed", "bucket", bucketName, "key", key)
 		return nil, err
 	}
+	defer response.Body.Close()
 
 	lastModified := response.LastModified.Format(http.TimeFormat)
-	size := int(*response.ContentLength)
-	imageBytes, err := io.ReadAll(response.Body)
+	contentLength := int64(-1)
+	if response.ContentLength != nil {
+		contentLength = *response.ContentLength
+	}
+
+	size := int(contentLength)
+	imageBytes, err := core.ReadImage(ctx, response.Body, contentLength)
 	if err != nil {
 		return nil, err
 	}
@@ -97,6 +148,8 @@ func (backend s3SourceBackend) FetchImage(imageSource string, timeout time.Durat
 		Bytes:        imageBytes,
 		Format:       vips.DetermineImageType(imageBytes),
 		LastModified: lastModified,
+		CacheControl: aws.ToString(response.CacheControl),
+		Expires:      aws.ToString(response.ExpiresString),
 	}
 
 	return &sourceImage, nil
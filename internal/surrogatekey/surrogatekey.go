@@ -0,0 +1,65 @@
+// Package surrogatekey computes the cache tags sent with images, so that every variant of a
+// source image can be purged from a CDN at once.
+package surrogatekey
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// maxValueLength bounds client ids and tags used in keys, longer values are left out.
+const maxValueLength = 128
+
+// Keys returns the surrogate keys for an image: one for its source URL, and one each for the v4
+// client id and the tag when they are set. Client ids and tags that aren't safe to use in a
+// header are left out.
+func Keys(sourceURL string, clientID string, tag string) []string {
+	keys := []string{Source(sourceURL)}
+
+	if validValue(clientID) {
+		keys = append(keys, "dims-client-"+clientID)
+	}
+
+	if validValue(tag) {
+		keys = append(keys, "dims-tag-"+tag)
+	}
+
+	return keys
+}
+
+// Source returns the key shared by every variant of a source image, a hash of its URL.
+func Source(sourceURL string) string {
+	sum := sha256.Sum256([]byte(sourceURL))
+
+	return "dims-src-" + hex.EncodeToString(sum[:16])
+}
+
+// Format joins keys for the named header: space separated for Surrogate-Key (i.e. Fastly), and
+// comma separated otherwise (i.e. Cloudflare's Cache-Tag).
+func Format(header string, keys []string) string {
+	if strings.EqualFold(header, "Surrogate-Key") {
+		return strings.Join(keys, " ")
+	}
+
+	return strings.Join(keys, ",")
+}
+
+// validValue accepts values of letters, digits, and a few punctuation characters, which every
+// CDN accepts in a key.
+func validValue(value string) bool {
+	if value == "" || len(value) > maxValueLength {
+		return false
+	}
+
+	for _, c := range value {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
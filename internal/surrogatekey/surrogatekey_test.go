@@ -0,0 +1,45 @@
+package surrogatekey
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeys(t *testing.T) {
+	source := Source("https://example.com/image.jpg")
+
+	tests := []struct {
+		name     string
+		clientID string
+		tag      string
+		want     []string
+	}{
+		{"source only", "", "", []string{source}},
+		{"client", "default", "", []string{source, "dims-client-default"}},
+		{"client and tag", "default", "homepage", []string{source, "dims-client-default", "dims-tag-homepage"}},
+		{"tag with spaces", "default", "home page", []string{source, "dims-client-default"}},
+		{"tag with comma", "", "a,b", []string{source}},
+		{"tag too long", "", strings.Repeat("a", maxValueLength+1), []string{source}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Keys("https://example.com/image.jpg", tt.clientID, tt.tag))
+		})
+	}
+}
+
+func TestSourceIsStable(t *testing.T) {
+	assert.Equal(t, "dims-src-e5db82b5bf63d49d80c5533616892d33", Source("https://example.com/image.jpg"))
+	assert.NotEqual(t, Source("https://example.com/image.jpg"), Source("https://example.com/other.jpg"))
+}
+
+func TestFormat(t *testing.T) {
+	keys := []string{"a", "b"}
+
+	assert.Equal(t, "a b", Format("Surrogate-Key", keys))
+	assert.Equal(t, "a b", Format("surrogate-key", keys))
+	assert.Equal(t, "a,b", Format("Cache-Tag", keys))
+}
@@ -0,0 +1,52 @@
+package tracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestHandlerContinuesTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	var outgoing http.Header
+
+	handler := Handler("dims.v5", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := Tracer.Start(r.Context(), "fetch")
+		defer span.End()
+
+		// The trace is passed on to the origin.
+		outgoing = make(http.Header)
+		Inject(ctx, outgoing)
+
+		w.WriteHeader(502)
+	}))
+
+	request := httptest.NewRequest("GET", "/v5/resize/10x10/?url=http://example.com/image.jpg", nil)
+	request.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	fetch, server := spans[0], spans[1]
+
+	assert.Equal(t, "dims.v5", server.Name())
+	assert.Equal(t, traceID, server.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+	assert.Contains(t, server.Attributes(), attribute.Int("http.response.status_code", 502))
+	assert.Equal(t, codes.Error, server.Status().Code)
+
+	assert.Equal(t, server.SpanContext().SpanID(), fetch.Parent().SpanID())
+	assert.True(t, strings.HasPrefix(outgoing.Get("traceparent"), "00-"+traceID+"-"+fetch.SpanContext().SpanID().String()))
+}
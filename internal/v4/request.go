@@ -3,6 +3,7 @@ package v4
 import (
 	"crypto/md5"
 	"fmt"
+	"github.com/beetlebugorg/go-dims/internal/accesslog"
 	"github.com/beetlebugorg/go-dims/internal/core"
 	dims "github.com/beetlebugorg/go-dims/internal/http"
 	"log/slog"
@@ -27,6 +28,9 @@ func NewRequest(r *http.Request, w http.ResponseWriter, config core.Config) (*Re
 	}
 
 	request.Signature = r.PathValue("signature")
+	request.ClientID = clientId
+
+	accesslog.SetClientID(r.Context(), clientId)
 
 	return &Request{
 		Request: request,
@@ -1,25 +1,47 @@
 package dims
 
 import (
+	"context"
+	"github.com/beetlebugorg/go-dims/internal/accesslog"
 	"github.com/beetlebugorg/go-dims/internal/core"
+	"github.com/beetlebugorg/go-dims/internal/metrics"
+	"github.com/beetlebugorg/go-dims/internal/peers"
+	"github.com/beetlebugorg/go-dims/internal/tracing"
 	"github.com/beetlebugorg/go-dims/internal/v4"
 	"github.com/beetlebugorg/go-dims/internal/v5"
 	"log/slog"
 	"net/http"
+	"os"
 
 	"github.com/beetlebugorg/go-dims/internal/dims"
 	_ "github.com/beetlebugorg/go-dims/internal/source"
 )
 
+// Handler serves the image endpoints, along with their status checks.
+type Handler struct {
+	http.Handler
+
+	config  core.Config
+	service *dims.Service
+}
+
+// NewHandler returns the image endpoints, along with their status checks.
 func NewHandler(config core.Config) http.Handler {
+	return New(config)
+}
+
+// New returns a handler with its own limiter, caches and peers, so several can run in one process.
+func New(config core.Config) *Handler {
+	service := dims.NewService(config)
 
 	mux := http.NewServeMux()
 
 	slog.Debug("startup", "config", config)
 
 	// v4 endpoint
-	mux.HandleFunc("/dims4/{clientId}/{signature}/{timestamp}/{commands...}",
-		func(w http.ResponseWriter, r *http.Request) {
+	mux.Handle("/dims4/{clientId}/{signature}/{timestamp}/{commands...}", tracing.Handler("dims.v4", metrics.InstrumentHandler("v4",
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			config := config
 			config.EtagAlgorithm = "md5"
 
 			request, err := v4.NewRequest(r, w, config)
@@ -29,17 +51,18 @@ func NewHandler(config core.Config) http.Handler {
 				return
 			}
 
-			if err := dims.Handler(request); err != nil {
+			if err := service.Handler(request); err != nil {
 				if err := request.SendError(err); err != nil {
 					slog.Error("error sending error response", "error", err)
 				}
 				return
 			}
-		})
+		}))))
 
 	// v5 endpoint
-	mux.HandleFunc("/v5/{commands...}",
-		func(w http.ResponseWriter, r *http.Request) {
+	mux.Handle("/v5/{commands...}", tracing.Handler("dims.v5", metrics.InstrumentHandler("v5",
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			config := config
 			config.EtagAlgorithm = "hmac-sha256"
 
 			request, err := v5.NewRequest(r, w, config)
@@ -49,22 +72,74 @@ func NewHandler(config core.Config) http.Handler {
 				return
 			}
 
-			if err := dims.Handler(request); err != nil {
+			if err := service.Handler(request); err != nil {
 				if err := request.SendError(err); err != nil {
 					slog.Error("error sending error response", "error", err)
 				}
 				return
 			}
-		})
-
-	mux.HandleFunc("/dims-status/",
-		func(w http.ResponseWriter, r *http.Request) {
-			dims.HandleDimsStatus(config, w, r)
-		})
-	mux.HandleFunc("/healthz",
-		func(w http.ResponseWriter, r *http.Request) {
-			dims.HandleDimsStatus(config, w, r)
-		})
-
-	return mux
+		}))))
+
+	// Runtime and admission stats, i.e. queue depth and wait time.
+	if config.DebugMode {
+		mux.HandleFunc("/debug/vars", service.HandleDebugVars)
+	}
+
+	mux.HandleFunc("/dims-status/", service.HandleDimsStatus)
+	mux.HandleFunc("/healthz", service.HandleDimsStatus)
+	mux.HandleFunc("/livez", dims.HandleLiveness)
+	mux.HandleFunc("/readyz", service.HandleReadiness)
+
+	// Every request gets an ID, access logs are optional.
+	var logger *slog.Logger
+	if config.AccessLog {
+		logger = accesslog.NewLogger(os.Stdout, config.LogFormat)
+	}
+
+	// Requests for images owned by another peer are forwarded to it.
+	var handler http.Handler = mux
+	if pool, err := peers.NewPool(config.Peers); err != nil {
+		slog.Error("peers disabled", "error", err)
+	} else if pool != nil {
+		handler = pool.Handler(mux)
+	}
+
+	return &Handler{
+		Handler: accesslog.Handler(logger, handler),
+		config:  config,
+		service: service,
+	}
+}
+
+// MetricsHandler serves the Prometheus metrics, it is meant to be exposed on a separate
+// address from the image endpoints.
+func (h *Handler) MetricsHandler() http.Handler {
+	return metrics.Handler(h.service.Gatherer())
+}
+
+// AdminHandler serves the admin endpoints, i.e. purging cached images. It is meant to be exposed
+// on a separate address from the image endpoints, and requires the DIMS_ADMIN_TOKEN bearer token.
+func (h *Handler) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/purge", h.service.HandlePurge)
+
+	return dims.RequireAdminToken(h.config, mux)
+}
+
+// Flush waits for the cached images being written in the background, it must be called before
+// the process exits.
+func (h *Handler) Flush() {
+	h.service.Flush()
+}
+
+// Wait waits until the handler's renders are done, including those abandoned after a timeout,
+// or until ctx is done. libvips must not be shut down before then.
+func (h *Handler) Wait(ctx context.Context) error {
+	return h.service.Wait(ctx)
+}
+
+// Drain marks the handler as shutting down, health checks fail from then on so that load
+// balancers stop sending new requests while in-flight requests finish.
+func (h *Handler) Drain() {
+	h.service.Drain()
 }
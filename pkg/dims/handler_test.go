@@ -0,0 +1,158 @@
+package dims
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/beetlebugorg/go-dims/internal/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSource serves resources/grid.png for test://grid.png, and 404 for any other image.
+type testSource struct {
+	fetches atomic.Int32
+}
+
+func (s *testSource) Name() string { return "test" }
+
+func (s *testSource) CanHandle(imageSource string) bool {
+	return strings.HasPrefix(imageSource, "test://")
+}
+
+func (s *testSource) FetchImage(ctx context.Context, imageSource string) (*core.Image, error) {
+	s.fetches.Add(1)
+
+	if imageSource != "test://grid.png" {
+		return nil, core.NewStatusError(404, "Image not found: "+imageSource)
+	}
+
+	data, err := os.ReadFile("../../resources/grid.png")
+	if err != nil {
+		return nil, err
+	}
+
+	return &core.Image{
+		Bytes:        data,
+		Size:         len(data),
+		Status:       200,
+		CacheControl: "max-age=60",
+	}, nil
+}
+
+var source = &testSource{}
+
+func init() {
+	core.RegisterImageBackend(source)
+}
+
+// newPeers starts n handlers that are each other's peers.
+func newPeers(t *testing.T, n int) []*httptest.Server {
+	servers := make([]*httptest.Server, n)
+	handlers := make([]http.Handler, n)
+
+	var urls []string
+	for i := range servers {
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers[i].ServeHTTP(w, r)
+		}))
+		t.Cleanup(servers[i].Close)
+
+		urls = append(urls, servers[i].URL)
+	}
+
+	for i := range handlers {
+		config := *core.ReadConfig()
+		config.DevelopmentMode = true
+		config.Source.Allowed = []string{"test"}
+		config.RenderCache.MaxBytes = 1 << 20
+		config.Peers.Self = servers[i].URL
+		config.Peers.List = urls
+		config.Peers.HealthInterval = 60
+		config.Peers.Secret = "secret"
+
+		handlers[i] = NewHandler(config)
+	}
+
+	return servers
+}
+
+func TestHandlerPeersRenderOnce(t *testing.T) {
+	servers := newPeers(t, 2)
+	before := source.fetches.Load()
+
+	var bodies, etags []string
+	for _, server := range servers {
+		response, err := http.Get(server.URL + "/v5/strip/true/?url=test://grid.png")
+		require.NoError(t, err)
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+
+		assert.Equal(t, 200, response.StatusCode)
+		bodies = append(bodies, string(body))
+		etags = append(etags, response.Header.Get("ETag"))
+	}
+
+	assert.Equal(t, bodies[0], bodies[1])
+	assert.Equal(t, etags[0], etags[1])
+	assert.Equal(t, int32(1), source.fetches.Load()-before, "only the owner fetches and renders the image")
+}
+
+func TestHandlerPeersPassThroughClientErrors(t *testing.T) {
+	servers := newPeers(t, 2)
+	before := source.fetches.Load()
+
+	for _, server := range servers {
+		response, err := http.Get(server.URL + "/v5/strip/true/?url=test://missing.png")
+		require.NoError(t, err)
+		response.Body.Close()
+
+		assert.Equal(t, 404, response.StatusCode)
+	}
+
+	// The replica that doesn't own the image sends the owner's 404 without fetching it again.
+	assert.Equal(t, int32(2), source.fetches.Load()-before)
+}
+
+func TestHandlerDrain(t *testing.T) {
+	draining := New(*core.ReadConfig())
+	serving := New(*core.ReadConfig())
+
+	draining.Drain()
+
+	recorder := httptest.NewRecorder()
+	draining.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 503, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	serving.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 200, recorder.Code, "handlers drain independently")
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	config := *core.ReadConfig()
+	config.DevelopmentMode = true
+	config.Source.Allowed = []string{"test"}
+	handler := New(config)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/v5/strip/true/?url=test://grid.png", nil))
+	require.Equal(t, 200, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	handler.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, 200, recorder.Code)
+
+	// The process metrics are served along with the handler's own.
+	body := recorder.Body.String()
+	assert.Contains(t, body, `dims_requests_total{code="200",endpoint="v5"}`)
+	assert.Contains(t, body, `dims_source_fetch_duration_seconds_count{backend="test"}`)
+	assert.Contains(t, body, "dims_admission_capacity ")
+	assert.Contains(t, body, "go_goroutines ")
+}
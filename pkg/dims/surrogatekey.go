@@ -0,0 +1,16 @@
+package dims
+
+import (
+	"github.com/beetlebugorg/go-dims/internal/surrogatekey"
+)
+
+// SurrogateKeys returns the surrogate keys sent with images of sourceURL, for the v4 clientID and
+// tag if set. Purging the first key from a CDN purges every variant of the source image.
+func SurrogateKeys(sourceURL string, clientID string, tag string) []string {
+	return surrogatekey.Keys(sourceURL, clientID, tag)
+}
+
+// FormatSurrogateKeys joins keys for the named header, i.e. Surrogate-Key or Cache-Tag.
+func FormatSurrogateKeys(header string, keys []string) string {
+	return surrogatekey.Format(header, keys)
+}